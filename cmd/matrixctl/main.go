@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/justinbarrick/go-matrix/pkg/api"
 	"github.com/justinbarrick/go-matrix/pkg/matrix"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -28,50 +35,144 @@ var registerCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		err = bot.Register(context.TODO(), args[1], args[2])
-		if err != nil {
+		if options := transportOptions(); options != nil {
+			if err := bot.SetTransportOptions(options); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := bot.DiscoverServer(context.TODO()); err != nil {
 			log.Fatal(err)
 		}
 
-		if err := matrix.Serialize(bot, viper.Get("config").(string)); err != nil {
+		err = bot.RegisterWithAuth(context.TODO(), args[1], args[2], registrationStages(&bot))
+		if err != nil {
 			log.Fatal(err)
 		}
 
+		saveBot(bot, configKey())
+
 		log.Println("Registered!")
 	},
 }
 
 var loginCmd = &cobra.Command{
 	Use:   "login [server] [username] [password]",
-	Short: "Login to a user account at a home server.",
-	Args:  cobra.ExactArgs(3),
+	Short: "Login to a user account at a home server, with a password, --sso, --token or --as-token.",
+	Args:  cobra.RangeArgs(1, 3),
 	Run: func(cmd *cobra.Command, args []string) {
 		bot, err := matrix.NewBot(args[0])
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if err := bot.Login(context.TODO(), args[1], args[2]); err != nil {
+		if options := transportOptions(); options != nil {
+			if err := bot.SetTransportOptions(options); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := bot.DiscoverServer(context.TODO()); err != nil {
 			log.Fatal(err)
 		}
 
-		if err := matrix.Serialize(bot, viper.Get("config").(string)); err != nil {
+		if viper.Get("listFlows").(bool) {
+			flows, err := bot.LoginFlows(context.TODO())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			for _, flow := range flows {
+				fmt.Println(flow)
+			}
+			return
+		}
+
+		switch {
+		case viper.Get("sso").(bool):
+			err = bot.LoginWithSSO(context.TODO(), func(url string) error {
+				fmt.Printf("Open this URL in a browser to log in:\n\n%s\n\n", url)
+				return nil
+			})
+		case viper.Get("token").(string) != "":
+			err = bot.LoginWithToken(context.TODO(), viper.Get("token").(string))
+		case viper.Get("asToken").(string) != "" && len(args) == 2:
+			err = bot.LoginAppService(context.TODO(), viper.Get("asToken").(string), args[1])
+		case len(args) == 3:
+			err = bot.Login(context.TODO(), args[1], args[2])
+		default:
+			log.Fatal("Pass a username and password, or log in with --sso, --token or --as-token and a username.")
+		}
+
+		if err != nil {
 			log.Fatal(err)
 		}
 
+		saveBot(bot, configKey())
+
 		log.Println("Logged in.")
 	},
 }
 
+// The user-interactive authentication stages matrixctl can complete to register.
+func registrationStages(bot *matrix.Bot) matrix.AuthStages {
+	stages := matrix.AuthStages{
+		matrix.AuthTerms: matrix.TermsAuth(acceptTerms),
+	}
+
+	if token := viper.Get("registrationToken").(string); token != "" {
+		stages[matrix.AuthRegistrationToken] = matrix.RegistrationTokenAuth(token)
+	}
+
+	if email := viper.Get("email").(string); email != "" {
+		stages[matrix.AuthEmailIdentity] = matrix.EmailIdentityAuth(func(c context.Context) (string, string, error) {
+			clientSecret := uuid.New().String()
+
+			sid, err := bot.RequestRegistrationEmailToken(c, email, clientSecret, 1)
+			if err != nil {
+				return "", "", err
+			}
+
+			fmt.Printf("Follow the link emailed to %s, then press enter.", email)
+			bufio.NewReader(os.Stdin).ReadString('\n')
+			return sid, clientSecret, nil
+		})
+	}
+
+	return stages
+}
+
+// Ask whether to accept the server's terms of service.
+func acceptTerms(policies map[string]interface{}) bool {
+	fmt.Println("The server asks you to accept its terms of service:")
+
+	for name, policy := range policies {
+		policy, _ := policy.(map[string]interface{})
+		translation, _ := policy["en"].(map[string]interface{})
+		fmt.Printf("  %s (version %v): %v\n", name, policy["version"], translation["url"])
+	}
+
+	fmt.Print("Do you accept them? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// Authenticate account changes with the password from --password.
+func passwordStages(bot matrix.Bot) matrix.AuthStages {
+	stages := matrix.AuthStages{}
+	if password := viper.Get("password").(string); password != "" {
+		stages[matrix.AuthPassword] = matrix.PasswordAuth(bot.UserId, password)
+	}
+	return stages
+}
+
 var logoutCmd = &cobra.Command{
 	Use:   "logout",
 	Short: "Logout the provided access token (or all sessions).",
 	Run: func(cmd *cobra.Command, args []string) {
-		bot, err := matrix.Unserialize(viper.Get("config").(string))
-		if err != nil {
-			log.Fatal(err)
-		}
+		bot := loadBot()
 
+		var err error
 		if viper.Get("all").(bool) {
 			err = bot.LogoutAll(context.TODO())
 		} else {
@@ -87,42 +188,608 @@ var logoutCmd = &cobra.Command{
 }
 
 var joinCmd = &cobra.Command{
-	Use:   "join [roomId]",
-	Short: "Join a room by id.",
+	Use:   "join [room]",
+	Short: "Join a room by ID, alias or matrix.to link.",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		bot, err := matrix.Unserialize(viper.Get("config").(string))
+		bot := loadBot()
+
+		if err := bot.JoinRoom(context.TODO(), resolveRoom(bot, args[0])); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var msgCmd = &cobra.Command{
+	Use:   "msg [room] [message]",
+	Short: "Send a message to the given room ID, alias or matrix.to link.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		var err error
+		if viper.Get("encrypted").(bool) {
+			err = bot.SendEncrypted(context.TODO(), room_id, args[1])
+		} else {
+			err = bot.Send(context.TODO(), room_id, args[1])
+		}
+
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if err := bot.JoinRoom(context.TODO(), args[0]); err != nil {
+		log.Println("Sent message to", room_id)
+	},
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Stream events from the server and print them.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		bot.OnSyncError(func(err error) {
+			log.Println("Error syncing:", err)
+		})
+		bot.On(matrix.AnyEvent, func(c context.Context, event *matrix.Event) {
+			content, _ := json.Marshal(event.Content)
+			log.Printf("[%s] %s %s %s: %s", event.Kind, event.RoomId, event.Sender, event.Type, content)
+		})
+
+		if err := bot.Sync(context.Background()); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
-var msgCmd = &cobra.Command{
-	Use:   "msg [roomId] [message]",
-	Short: "Send a message to the given roomId.",
+var roomCmd = &cobra.Command{
+	Use:   "room",
+	Short: "Create rooms and manage their state and members.",
+}
+
+var roomCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a room and print its room ID.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		room_id, err := bot.CreateRoom(context.TODO(), matrix.RoomOptions{
+			Name:      viper.Get("roomName").(string),
+			Topic:     viper.Get("topic").(string),
+			Preset:    viper.Get("preset").(string),
+			Alias:     viper.Get("alias").(string),
+			Public:    viper.Get("public").(bool),
+			Invite:    viper.GetStringSlice("invite"),
+			Encrypted: viper.Get("encrypt").(bool),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(room_id)
+	},
+}
+
+var roomStateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Read and set room state events.",
+}
+
+var roomStateGetCmd = &cobra.Command{
+	Use:   "get [room] [eventType] [stateKey]",
+	Short: "Print the content of a room state event.",
+	Args:  cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		stateKey := ""
+		if len(args) > 2 {
+			stateKey = args[2]
+		}
+
+		content := map[string]interface{}{}
+		if err := bot.RoomState(context.TODO(), room_id, args[1], stateKey, &content); err != nil {
+			log.Fatal(err)
+		}
+
+		output, _ := json.MarshalIndent(content, "", "  ")
+		fmt.Println(string(output))
+	},
+}
+
+var roomStateSetCmd = &cobra.Command{
+	Use:   "set [room] [eventType] [content] [stateKey]",
+	Short: "Set a room state event, its content is given as JSON.",
+	Args:  cobra.RangeArgs(3, 4),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		stateKey := ""
+		if len(args) > 3 {
+			stateKey = args[3]
+		}
+
+		content := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(args[2]), &content); err != nil {
+			log.Fatal("Invalid content: ", err)
+		}
+
+		eventId, err := bot.SetRoomState(context.TODO(), room_id, args[1], stateKey, content)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Set %s in %s: %s", args[1], room_id, eventId)
+	},
+}
+
+var roomInviteCmd = &cobra.Command{
+	Use:   "invite [room] [userId]",
+	Short: "Invite a user to a room.",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		bot, err := matrix.Unserialize(viper.Get("config").(string))
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.InviteUser(context.TODO(), room_id, args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Invited %s to %s", args[1], room_id)
+	},
+}
+
+var roomLeaveCmd = &cobra.Command{
+	Use:   "leave [room]",
+	Short: "Leave a room or reject an invite to it.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.LeaveRoom(context.TODO(), room_id); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Left %s", room_id)
+	},
+}
+
+var roomForgetCmd = &cobra.Command{
+	Use:   "forget [room]",
+	Short: "Forget a room that we have left.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.ForgetRoom(context.TODO(), room_id); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Forgot %s", room_id)
+	},
+}
+
+var roomKickCmd = &cobra.Command{
+	Use:   "kick [room] [userId]",
+	Short: "Kick a user out of a room.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.KickUser(context.TODO(), room_id, args[1], viper.Get("kickReason").(string)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Kicked %s from %s", args[1], room_id)
+	},
+}
+
+var roomBanCmd = &cobra.Command{
+	Use:   "ban [room] [userId]",
+	Short: "Ban a user from a room.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.BanUser(context.TODO(), room_id, args[1], viper.Get("banReason").(string)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Banned %s from %s", args[1], room_id)
+	},
+}
+
+var roomUnbanCmd = &cobra.Command{
+	Use:   "unban [room] [userId]",
+	Short: "Lift a user's ban from a room.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[0])
+
+		if err := bot.UnbanUser(context.TODO(), room_id, args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Unbanned %s from %s", args[1], room_id)
+	},
+}
+
+var aliasCmd = &cobra.Command{
+	Use:   "alias",
+	Short: "Manage room aliases in the room directory.",
+}
+
+var aliasSetCmd = &cobra.Command{
+	Use:   "set [alias] [room]",
+	Short: "Point a room alias, such as #ops:example.org, at a room.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		room_id := resolveRoom(bot, args[1])
+
+		if err := bot.SetRoomAlias(context.TODO(), args[0], room_id); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Set %s to %s", args[0], room_id)
+	},
+}
+
+var aliasDeleteCmd = &cobra.Command{
+	Use:   "delete [alias]",
+	Short: "Remove a room alias.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if err := bot.DeleteRoomAlias(context.TODO(), args[0]); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Deleted %s", args[0])
+	},
+}
+
+var aliasResolveCmd = &cobra.Command{
+	Use:   "resolve [room]",
+	Short: "Print the room ID of a room alias, matrix.to link or matrix: URI.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+		fmt.Println(resolveRoom(bot, args[0]))
+	},
+}
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "Manage our devices and which devices are trusted with room keys.",
+}
+
+var devicesListCmd = &cobra.Command{
+	Use:   "list [userId...]",
+	Short: "List the devices of the given users and their trust state, or those logged in to our account.",
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if len(args) == 0 {
+			listAccountDevices(bot)
+			return
+		}
+
+		devices, err := bot.QueryDevices(context.TODO(), args...)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if viper.Get("encrypted").(bool) {
-			err = bot.SendEncrypted(context.TODO(), args[0], args[1])
-		} else {
-			err = bot.Send(context.TODO(), args[0], args[1])
+		for _, device := range devices {
+			fmt.Printf("%s\t%s\t%s\t%s\n", device.UserId, device.DeviceId, device.Trust, device.Ed25519Key)
 		}
+	},
+}
+
+// Print the devices logged in to our account with when they were last seen.
+func listAccountDevices(bot matrix.Bot) {
+	devices, err := bot.AccountDevices(context.TODO())
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	keys, err := bot.QueryDevices(context.TODO(), bot.UserId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trust := map[string]matrix.TrustState{}
+	for _, key := range keys {
+		trust[key.DeviceId] = key.Trust
+	}
+
+	for _, device := range devices {
+		lastSeen := "never"
+		if !device.LastSeen.IsZero() {
+			lastSeen = device.LastSeen.Format(time.RFC3339)
+		}
+
+		current := ""
+		if device.DeviceId == bot.DeviceId {
+			current = " (this device)"
+		}
+
+		fmt.Printf("%s\t%s\t%s\t%s\t%s%s\n", device.DeviceId, device.DisplayName, lastSeen, device.LastSeenIP, trust[device.DeviceId], current)
+	}
+}
+
+var devicesRenameCmd = &cobra.Command{
+	Use:   "rename [deviceId] [name]",
+	Short: "Set the display name of one of our devices.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if err := bot.RenameDevice(context.TODO(), args[0], args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Renamed %s to %s.", args[0], args[1])
+	},
+}
+
+var devicesDeleteCmd = &cobra.Command{
+	Use:   "delete [deviceId...]",
+	Short: "Log out and delete our devices, the password is passed with --password.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if err := bot.DeleteDevices(context.TODO(), args, passwordStages(bot)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Deleted %s.", strings.Join(args, ", "))
+	},
+}
+
+var devicesPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete our devices that have not been seen for --older-than, the password is passed with --password.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		pruned, err := bot.PruneDevices(context.TODO(), viper.GetDuration("olderThan"), passwordStages(bot))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Deleted %d devices.", len(pruned))
+	},
+}
+
+// Build a command that sets the trust state of a device.
+func deviceTrustCmd(use, short string, trust matrix.TrustState) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " [userId] [deviceId]",
+		Short: short,
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			bot := loadBot()
+
+			if _, err := bot.QueryDevices(context.TODO(), args[0]); err != nil {
+				log.Fatal(err)
+			}
+
+			if err := bot.SetDeviceTrust(args[0], args[1], trust); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Marked %s %s as %s.", args[0], args[1], trust)
+		},
+	}
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [userId] [deviceId]",
+	Short: "Verify a device by comparing emoji with it.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		log.Printf("Waiting for %s %s to accept the verification request...", args[0], args[1])
+
+		err := bot.VerifyDeviceSAS(context.Background(), args[0], args[1], func(sas *matrix.SAS) bool {
+			fmt.Printf("\n%s\n\nDo the emoji match those shown on the other device? [y/N] ", sas)
+
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			return strings.ToLower(strings.TrimSpace(answer)) == "y"
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Verified %s %s.", args[0], args[1])
+	},
+}
+
+var crossSigningCmd = &cobra.Command{
+	Use:   "cross-signing",
+	Short: "Manage the bot's cross-signing keys.",
+}
+
+var crossSigningBootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "Create and upload cross-signing keys if needed and sign this device with them.",
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if err := bot.BootstrapCrossSigning(context.TODO(), viper.Get("password").(string)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Cross-signing is set up, master key: %s", bot.MasterKey())
+	},
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Manage the bot's account.",
+}
+
+var accountPasswordCmd = &cobra.Command{
+	Use:   "password [newPassword]",
+	Short: "Change the account password, the current one is passed with --password.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		err := bot.ChangePassword(context.TODO(), args[0], viper.Get("logoutDevices").(bool), passwordStages(bot))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Changed password.")
+	},
+}
+
+var accountDeactivateCmd = &cobra.Command{
+	Use:   "deactivate",
+	Short: "Deactivate the account for good, the password is passed with --password.",
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		if err := bot.DeactivateAccount(context.TODO(), viper.Get("erase").(bool), passwordStages(bot)); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Deactivated the account.")
+	},
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage room keys.",
+}
+
+var keysBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Manage the server-side backup of room keys.",
+}
+
+var keysBackupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a new key backup and print its recovery key.",
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		recoveryKey, err := bot.CreateKeyBackup(context.TODO())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Recovery key (keep it somewhere safe): %s\n", recoveryKey)
+	},
+}
+
+var keysBackupRestoreCmd = &cobra.Command{
+	Use:   "restore [recoveryKey]",
+	Short: "Restore room keys from the key backup.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		count, err := bot.RestoreKeyBackup(context.TODO(), args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Restored %d sessions.", count)
+	},
+}
+
+var keysExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Export room keys to a passphrase protected file that other clients can import.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		export, err := bot.ExportRoomKeys(keyPassphrase())
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		log.Println("Sent message to", args[0])
+		if err := ioutil.WriteFile(args[0], export, 0600); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Exported room keys to %s.", args[0])
+	},
+}
+
+var keysImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Import room keys exported by matrixctl or another client.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bot := loadBot()
+
+		export, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		count, err := bot.ImportRoomKeys(export, keyPassphrase())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Imported %d sessions.", count)
+	},
+}
+
+// The passphrase protecting a key export.
+func keyPassphrase() string {
+	passphrase := viper.Get("passphrase").(string)
+	if passphrase == "" {
+		log.Fatal("A passphrase is required, pass --passphrase or set MATRIX_KEY_PASSPHRASE.")
+	}
+	return passphrase
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage encryption of the config file.",
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the config with the key in $MATRIX_CONFIG_KEY or $MATRIX_CONFIG_KEY_FILE.",
+	Run: func(cmd *cobra.Command, args []string) {
+		key := configKey()
+		if key == "" {
+			log.Fatal("Set MATRIX_CONFIG_KEY or MATRIX_CONFIG_KEY_FILE to encrypt the config.")
+		}
+
+		rekeyBot(loadBot(), key)
+		log.Println("Encrypted the config.")
+	},
+}
+
+var configDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Decrypt the config so that it can be read without a key.",
+	Run: func(cmd *cobra.Command, args []string) {
+		rekeyBot(loadBot(), "")
+		log.Println("Decrypted the config.")
 	},
 }
 
@@ -131,10 +798,7 @@ var slack2matrixCmd = &cobra.Command{
 	Short: "Starts a slack2matrix endpoint that can receive slack webhooks and forward them to matrix.",
 	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		bot, err := matrix.Unserialize(viper.Get("config").(string))
-		if err != nil {
-			log.Fatal(err)
-		}
+		bot := loadBot()
 
 		channel := os.Getenv("MATRIX_CHAN")
 		if len(args) > 0 {
@@ -144,25 +808,183 @@ var slack2matrixCmd = &cobra.Command{
 	},
 }
 
-func main() {
-	defaultConfig := os.Getenv("MATRIX_CONFIG")
-	if defaultConfig == "" {
-		usr, err := user.Current()
+// Open the store selected with --store, or the config and crypto store files.
+func openStore() matrix.Store {
+	if storeUrl := viper.Get("store").(string); storeUrl != "" {
+		store, err := matrix.OpenStore(storeUrl)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defaultConfig = filepath.Join(usr.HomeDir, ".matrix/config.json")
+		return store
+	}
+
+	return matrix.FileStore{
+		ConfigPath: viper.Get("config").(string),
+		SyncPath:   viper.Get("config").(string) + ".next_batch",
+		CryptoPath: viper.Get("cryptoStore").(string),
+	}
+}
+
+func configKey() string {
+	key, err := matrix.ConfigKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// Load the bot with its encryption state and apply the key sharing policy.
+func loadBot() matrix.Bot {
+	bot, err := matrix.LoadBot(openStore(), configKey())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if options := transportOptions(); options != nil {
+		if err := bot.SetTransportOptions(options); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	rootCmd.PersistentFlags().StringP("config", "c", defaultConfig, "authentication configuration to load")
+	if viper.Get("verifiedOnly").(bool) {
+		bot.SetKeySharePolicy(matrix.ShareWithVerified)
+	}
+
+	// Log in again with the same device if the access token cannot be refreshed.
+	bot.OnSoftLogout(func(c context.Context, bot *matrix.Bot) error {
+		password := os.Getenv("MATRIX_PASSWORD")
+		if password == "" {
+			return fmt.Errorf("Logged out, set MATRIX_PASSWORD to log in again automatically")
+		}
+
+		return bot.Login(c, bot.UserId, password)
+	})
+
+	return bot
+}
+
+// Resolve a room given as a room ID, alias, matrix.to link or matrix: URI to its room ID.
+func resolveRoom(bot matrix.Bot, room string) string {
+	room_id, err := bot.ResolveRoom(context.TODO(), room)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return room_id
+}
+
+// The connection settings from the command line, nil if none were given so that the
+// saved ones are used.
+func transportOptions() *matrix.TransportOptions {
+	options := matrix.TransportOptions{
+		CAFile:         viper.Get("caFile").(string),
+		CertFile:       viper.Get("clientCert").(string),
+		KeyFile:        viper.Get("clientKey").(string),
+		Proxy:          viper.Get("proxy").(string),
+		ConnectTimeout: viper.GetDuration("connectTimeout"),
+		Timeout:        viper.GetDuration("timeout"),
+	}
+
+	if options == (matrix.TransportOptions{}) {
+		return nil
+	}
+	return &options
+}
+
+// Save the bot's credentials, encrypted with key unless it is empty.
+func saveBot(bot matrix.Bot, key string) {
+	if err := matrix.SaveBot(openStore(), bot, key); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Save the config and the crypto state again, encrypted with key or decrypted if it is
+// empty.
+func rekeyBot(bot matrix.Bot, key string) {
+	if err := matrix.RekeyBot(openStore(), bot, key); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func defaultPath(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(usr.HomeDir, ".matrix", name)
+}
+
+func main() {
+	rootCmd.PersistentFlags().StringP("config", "c", defaultPath("MATRIX_CONFIG", "config.json"), "authentication configuration to load")
+	rootCmd.PersistentFlags().StringP("crypto-store", "", defaultPath("MATRIX_CRYPTO_STORE", "crypto.json"), "file to persist encryption sessions to")
+	rootCmd.PersistentFlags().StringP("store", "", os.Getenv("MATRIX_STORE"), "where to keep credentials and state: file:///path/config.json, dir:///path, sqlite:///path/matrix.db or memory: (overrides --config and --crypto-store)")
+	rootCmd.PersistentFlags().BoolP("verified-only", "", false, "only share room keys with verified devices")
+	rootCmd.PersistentFlags().StringP("ca-file", "", "", "PEM file of extra CA certificates to trust for the homeserver (saved by login and register)")
+	rootCmd.PersistentFlags().StringP("client-cert", "", "", "PEM client certificate to present to the homeserver (saved by login and register)")
+	rootCmd.PersistentFlags().StringP("client-key", "", "", "PEM key of the client certificate (saved by login and register)")
+	rootCmd.PersistentFlags().StringP("proxy", "", "", "proxy URL for requests to the homeserver, defaults to $HTTPS_PROXY (saved by login and register)")
+	rootCmd.PersistentFlags().DurationP("connect-timeout", "", 0, "how long to wait to connect to the homeserver (saved by login and register)")
+	rootCmd.PersistentFlags().DurationP("timeout", "", 0, "how long to wait for each request to the homeserver (saved by login and register)")
 	logoutCmd.PersistentFlags().BoolP("all", "a", false, "logout all devices")
 	msgCmd.PersistentFlags().BoolP("encrypted", "e", false, "send an encrypted message")
+	rootCmd.PersistentFlags().StringP("password", "p", os.Getenv("MATRIX_PASSWORD"), "account password, if the server asks for it to authenticate a change")
+	loginCmd.PersistentFlags().BoolP("list-flows", "", false, "list the login types the server supports")
+	loginCmd.PersistentFlags().BoolP("sso", "", false, "log in with the server's single sign-on in a browser")
+	loginCmd.PersistentFlags().StringP("token", "", "", "log in with a login token")
+	loginCmd.PersistentFlags().StringP("as-token", "", os.Getenv("MATRIX_AS_TOKEN"), "log in as a user of an application service with its as_token")
+	registerCmd.PersistentFlags().StringP("registration-token", "", os.Getenv("MATRIX_REGISTRATION_TOKEN"), "registration token, if the server requires one to register")
+	registerCmd.PersistentFlags().StringP("email", "", "", "email address to validate, if the server requires one to register")
+	roomCreateCmd.PersistentFlags().StringP("name", "", "", "room name")
+	roomCreateCmd.PersistentFlags().StringP("topic", "", "", "room topic")
+	roomCreateCmd.PersistentFlags().StringP("preset", "", "", "private_chat, trusted_private_chat or public_chat")
+	roomCreateCmd.PersistentFlags().StringP("alias", "", "", "local part of an alias for the room")
+	roomCreateCmd.PersistentFlags().BoolP("public", "", false, "publish the room in the room directory")
+	roomCreateCmd.PersistentFlags().StringSliceP("invite", "", nil, "user IDs to invite")
+	roomCreateCmd.PersistentFlags().BoolP("encrypt", "", false, "turn on end-to-end encryption")
+	roomKickCmd.PersistentFlags().StringP("reason", "", "", "reason for the kick")
+	roomBanCmd.PersistentFlags().StringP("reason", "", "", "reason for the ban")
+	devicesPruneCmd.PersistentFlags().DurationP("older-than", "", 30*24*time.Hour, "delete devices last seen longer ago than this")
+	accountPasswordCmd.PersistentFlags().BoolP("logout-devices", "", false, "log out every other device")
+	accountDeactivateCmd.PersistentFlags().BoolP("erase", "", false, "ask the server to forget the messages sent by the account")
+	keysCmd.PersistentFlags().StringP("passphrase", "", os.Getenv("MATRIX_KEY_PASSPHRASE"), "passphrase protecting exported room keys")
 	slack2matrixCmd.PersistentFlags().StringP("cert-path", "", "", "path to TLS certificate")
 	slack2matrixCmd.PersistentFlags().StringP("key-path", "", "", "path to TLS key")
 
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+	viper.BindPFlag("cryptoStore", rootCmd.PersistentFlags().Lookup("crypto-store"))
+	viper.BindPFlag("store", rootCmd.PersistentFlags().Lookup("store"))
+	viper.BindPFlag("verifiedOnly", rootCmd.PersistentFlags().Lookup("verified-only"))
+	viper.BindPFlag("caFile", rootCmd.PersistentFlags().Lookup("ca-file"))
+	viper.BindPFlag("clientCert", rootCmd.PersistentFlags().Lookup("client-cert"))
+	viper.BindPFlag("clientKey", rootCmd.PersistentFlags().Lookup("client-key"))
+	viper.BindPFlag("proxy", rootCmd.PersistentFlags().Lookup("proxy"))
+	viper.BindPFlag("connectTimeout", rootCmd.PersistentFlags().Lookup("connect-timeout"))
+	viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
 	viper.BindPFlag("all", logoutCmd.PersistentFlags().Lookup("all"))
 	viper.BindPFlag("encrypted", msgCmd.PersistentFlags().Lookup("encrypted"))
+	viper.BindPFlag("password", rootCmd.PersistentFlags().Lookup("password"))
+	viper.BindPFlag("listFlows", loginCmd.PersistentFlags().Lookup("list-flows"))
+	viper.BindPFlag("sso", loginCmd.PersistentFlags().Lookup("sso"))
+	viper.BindPFlag("token", loginCmd.PersistentFlags().Lookup("token"))
+	viper.BindPFlag("asToken", loginCmd.PersistentFlags().Lookup("as-token"))
+	viper.BindPFlag("registrationToken", registerCmd.PersistentFlags().Lookup("registration-token"))
+	viper.BindPFlag("email", registerCmd.PersistentFlags().Lookup("email"))
+	viper.BindPFlag("roomName", roomCreateCmd.PersistentFlags().Lookup("name"))
+	viper.BindPFlag("topic", roomCreateCmd.PersistentFlags().Lookup("topic"))
+	viper.BindPFlag("preset", roomCreateCmd.PersistentFlags().Lookup("preset"))
+	viper.BindPFlag("alias", roomCreateCmd.PersistentFlags().Lookup("alias"))
+	viper.BindPFlag("public", roomCreateCmd.PersistentFlags().Lookup("public"))
+	viper.BindPFlag("invite", roomCreateCmd.PersistentFlags().Lookup("invite"))
+	viper.BindPFlag("encrypt", roomCreateCmd.PersistentFlags().Lookup("encrypt"))
+	viper.BindPFlag("kickReason", roomKickCmd.PersistentFlags().Lookup("reason"))
+	viper.BindPFlag("banReason", roomBanCmd.PersistentFlags().Lookup("reason"))
+	viper.BindPFlag("olderThan", devicesPruneCmd.PersistentFlags().Lookup("older-than"))
+	viper.BindPFlag("logoutDevices", accountPasswordCmd.PersistentFlags().Lookup("logout-devices"))
+	viper.BindPFlag("erase", accountDeactivateCmd.PersistentFlags().Lookup("erase"))
+	viper.BindPFlag("passphrase", keysCmd.PersistentFlags().Lookup("passphrase"))
 	viper.BindPFlag("certPath", slack2matrixCmd.PersistentFlags().Lookup("cert-path"))
 	viper.BindPFlag("keyPath", slack2matrixCmd.PersistentFlags().Lookup("key-path"))
 
@@ -171,8 +993,48 @@ func main() {
 	rootCmd.AddCommand(logoutCmd)
 	rootCmd.AddCommand(joinCmd)
 	rootCmd.AddCommand(msgCmd)
+	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(slack2matrixCmd)
 
+	roomStateCmd.AddCommand(roomStateGetCmd)
+	roomStateCmd.AddCommand(roomStateSetCmd)
+	roomCmd.AddCommand(roomCreateCmd)
+	roomCmd.AddCommand(roomStateCmd)
+	roomCmd.AddCommand(roomInviteCmd)
+	roomCmd.AddCommand(roomLeaveCmd)
+	roomCmd.AddCommand(roomForgetCmd)
+	roomCmd.AddCommand(roomKickCmd)
+	roomCmd.AddCommand(roomBanCmd)
+	roomCmd.AddCommand(roomUnbanCmd)
+	rootCmd.AddCommand(roomCmd)
+	aliasCmd.AddCommand(aliasSetCmd)
+	aliasCmd.AddCommand(aliasDeleteCmd)
+	aliasCmd.AddCommand(aliasResolveCmd)
+	rootCmd.AddCommand(aliasCmd)
+	devicesCmd.AddCommand(devicesListCmd)
+	devicesCmd.AddCommand(devicesRenameCmd)
+	devicesCmd.AddCommand(devicesDeleteCmd)
+	devicesCmd.AddCommand(devicesPruneCmd)
+	devicesCmd.AddCommand(deviceTrustCmd("verify", "Trust a device after checking its ed25519 key out of band.", matrix.DeviceVerified))
+	devicesCmd.AddCommand(deviceTrustCmd("unverify", "Reset a device to unverified.", matrix.DeviceUnverified))
+	devicesCmd.AddCommand(deviceTrustCmd("blacklist", "Never share room keys with a device.", matrix.DeviceBlacklisted))
+	rootCmd.AddCommand(devicesCmd)
+	rootCmd.AddCommand(verifyCmd)
+	accountCmd.AddCommand(accountPasswordCmd)
+	accountCmd.AddCommand(accountDeactivateCmd)
+	rootCmd.AddCommand(accountCmd)
+	crossSigningCmd.AddCommand(crossSigningBootstrapCmd)
+	rootCmd.AddCommand(crossSigningCmd)
+	keysBackupCmd.AddCommand(keysBackupCreateCmd)
+	keysBackupCmd.AddCommand(keysBackupRestoreCmd)
+	keysCmd.AddCommand(keysBackupCmd)
+	keysCmd.AddCommand(keysExportCmd)
+	keysCmd.AddCommand(keysImportCmd)
+	rootCmd.AddCommand(keysCmd)
+	configCmd.AddCommand(configEncryptCmd)
+	configCmd.AddCommand(configDecryptCmd)
+	rootCmd.AddCommand(configCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -74,7 +74,17 @@ func Api(bot matrix.Bot, defaultChannel, certPath, keyPath string) {
 			return
 		}
 
-		channel = fmt.Sprintf("!%s", strings.TrimLeft(channel, "#!"))
+		// Room IDs may be given without their "!".
+		if !strings.HasPrefix(channel, "!") && !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "matrix:") && !strings.HasPrefix(channel, "https:") {
+			channel = fmt.Sprintf("!%s", channel)
+		}
+
+		channel, err = bot.ResolveRoom(r.Context(), channel)
+		if err != nil {
+			log.Println("Error resolving channel:", err.Error())
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		span.AddAttributes(trace.StringAttribute("channel", channel))
 
 		webhookBody, err := message.ToHTML()
@@ -0,0 +1,194 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/device_management"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// A device logged in to the bot's account.
+type AccountDevice struct {
+	DeviceId    string
+	DisplayName string
+	LastSeenIP  string
+	// Zero if the server does not know when the device was last used.
+	LastSeen time.Time
+}
+
+// Change the account's password, authenticating with stages, usually the current
+// password. If logoutDevices is set every other device is logged out.
+func (b *Bot) ChangePassword(c context.Context, newPassword string, logoutDevices bool, stages AuthStages) error {
+	body := map[string]interface{}{
+		"new_password":   newPassword,
+		"logout_devices": logoutDevices,
+	}
+
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			body["auth"] = auth
+		}
+		return b.doJSON(c, "POST", "/account/password", body, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not change password: %w", err)
+	}
+
+	return nil
+}
+
+// Deactivate the account, authenticating with stages. If erase is set the server is
+// asked to forget the messages it sent. The account cannot be used again.
+func (b *Bot) DeactivateAccount(c context.Context, erase bool, stages AuthStages) error {
+	body := map[string]interface{}{
+		"erase": erase,
+	}
+
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			body["auth"] = auth
+		}
+		return b.doJSON(c, "POST", "/account/deactivate", body, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not deactivate account: %w", err)
+	}
+
+	return nil
+}
+
+// List the devices logged in to the bot's account, sorted by device ID.
+func (b *Bot) AccountDevices(c context.Context) ([]*AccountDevice, error) {
+	result, err := b.client.DeviceManagement.GetDevices(device_management.NewGetDevicesParamsWithContext(c), b)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list devices: %w", err)
+	}
+
+	devices := []*AccountDevice{}
+	for _, item := range result.Payload.Devices {
+		if item.DeviceID == nil {
+			continue
+		}
+
+		device := &AccountDevice{
+			DeviceId:    *item.DeviceID,
+			DisplayName: item.DisplayName,
+			LastSeenIP:  item.LastSeenIP,
+		}
+		if item.LastSeenTs > 0 {
+			device.LastSeen = time.Unix(0, item.LastSeenTs*int64(time.Millisecond))
+		}
+
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+
+	return devices, nil
+}
+
+// Set the display name of one of the account's devices.
+func (b *Bot) RenameDevice(c context.Context, deviceId, displayName string) error {
+	params := device_management.NewUpdateDeviceParamsWithContext(c)
+	params.SetDeviceID(deviceId)
+	params.SetBody(&models.UpdateDeviceParamsBody{
+		DisplayName: displayName,
+	})
+
+	if _, err := b.client.DeviceManagement.UpdateDevice(params, b); err != nil {
+		return fmt.Errorf("Could not rename device %s: %w", deviceId, err)
+	}
+
+	return nil
+}
+
+// Delete one of the account's devices, logging it out, authenticating with stages.
+func (b *Bot) DeleteDevice(c context.Context, deviceId string, stages AuthStages) error {
+	params := device_management.NewDeleteDeviceParamsWithContext(c)
+	params.SetDeviceID(deviceId)
+	params.SetBody(&models.DeleteDeviceParamsBody{})
+
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			params.Body.Auth = &models.DeleteDeviceParamsBodyAuth{}
+			if err := decodeAuth(auth, params.Body.Auth); err != nil {
+				return err
+			}
+		}
+
+		_, err := b.client.DeviceManagement.DeleteDevice(params, b)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not delete device %s: %w", deviceId, err)
+	}
+
+	return nil
+}
+
+// Delete several of the account's devices at once, authenticating with stages.
+func (b *Bot) DeleteDevices(c context.Context, deviceIds []string, stages AuthStages) error {
+	params := device_management.NewDeleteDevicesParamsWithContext(c)
+	params.SetBody(&models.DeleteDevicesParamsBody{
+		Devices: deviceIds,
+	})
+
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			params.Body.Auth = &models.DeleteDevicesParamsBodyAuth{}
+			if err := decodeAuth(auth, params.Body.Auth); err != nil {
+				return err
+			}
+		}
+
+		_, err := b.client.DeviceManagement.DeleteDevices(params, b)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not delete devices: %w", err)
+	}
+
+	return nil
+}
+
+// Delete the account's devices that have not been used for longer than olderThan, such
+// as the ones left behind by earlier logins, authenticating with stages. The bot's own
+// device and devices the server has no last seen time for are kept. Returns the IDs of
+// the deleted devices.
+func (b *Bot) PruneDevices(c context.Context, olderThan time.Duration, stages AuthStages) ([]string, error) {
+	devices, err := b.AccountDevices(c)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []string{}
+	for _, device := range devices {
+		if device.DeviceId == b.DeviceId || device.LastSeen.IsZero() || time.Since(device.LastSeen) <= olderThan {
+			continue
+		}
+		stale = append(stale, device.DeviceId)
+	}
+
+	if len(stale) == 0 {
+		return stale, nil
+	}
+
+	return stale, b.DeleteDevices(c, stale, stages)
+}
+
+// Convert an auth dict to one of the generated auth models, which keep the keys of the
+// stage as additional properties.
+func decodeAuth(auth map[string]interface{}, model interface{}) error {
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, model)
+}
@@ -0,0 +1,113 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountDevices(t *testing.T) {
+	now := time.Now()
+	deleted := []interface{}{}
+	renamed := map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		body := map[string]interface{}{}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/devices":
+			fmt.Fprintf(w, `{"devices": [
+				{"device_id": "STALE", "display_name": "old login", "last_seen_ts": %d, "last_seen_ip": "10.0.0.1"},
+				{"device_id": "BOTDEVICE", "last_seen_ts": %d},
+				{"device_id": "RECENT", "last_seen_ts": %d},
+				{"device_id": "UNKNOWN"}
+			]}`, now.Add(-48*time.Hour).UnixNano()/int64(time.Millisecond), now.Add(-72*time.Hour).UnixNano()/int64(time.Millisecond), now.UnixNano()/int64(time.Millisecond))
+		case "/_matrix/client/unstable/devices/RECENT":
+			assert.Equal(t, "PUT", r.Method)
+			renamed = body
+			fmt.Fprint(w, `{}`)
+		case "/_matrix/client/unstable/delete_devices":
+			if body["auth"] == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"session": "abc", "flows": [{"stages": ["m.login.password"]}]}`)
+				return
+			}
+
+			auth := body["auth"].(map[string]interface{})
+			assert.Equal(t, "m.login.password", auth["type"])
+			assert.Equal(t, "password", auth["password"])
+			deleted = body["devices"].([]interface{})
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	devices, err := bot.AccountDevices(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(devices))
+	assert.Equal(t, "BOTDEVICE", devices[0].DeviceId)
+	assert.Equal(t, "STALE", devices[2].DeviceId)
+	assert.Equal(t, "old login", devices[2].DisplayName)
+	assert.Equal(t, "10.0.0.1", devices[2].LastSeenIP)
+	assert.Equal(t, now.Add(-48*time.Hour).Unix(), devices[2].LastSeen.Unix())
+	assert.True(t, devices[3].LastSeen.IsZero())
+
+	assert.Nil(t, bot.RenameDevice(context.TODO(), "RECENT", "laptop"))
+	assert.Equal(t, "laptop", renamed["display_name"])
+
+	// Only devices other than ours that were last seen too long ago are deleted.
+	pruned, err := bot.PruneDevices(context.TODO(), 24*time.Hour, AuthStages{
+		AuthPassword: PasswordAuth(bot.UserId, "password"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"STALE"}, pruned)
+	assert.Equal(t, []interface{}{"STALE"}, deleted)
+}
+
+func TestDeleteDevice(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		requests++
+
+		assert.Equal(t, "DELETE", r.Method)
+		assert.Equal(t, "/_matrix/client/unstable/devices/OTHER%2FDEVICE", r.URL.EscapedPath())
+
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		if body["auth"] == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"session": "abc", "flows": [{"stages": ["m.login.password"]}]}`)
+			return
+		}
+
+		auth := body["auth"].(map[string]interface{})
+		assert.Equal(t, "m.login.password", auth["type"])
+		assert.Equal(t, "abc", auth["session"])
+		assert.Equal(t, "password", auth["password"])
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	assert.Nil(t, bot.DeleteDevice(context.TODO(), "OTHER/DEVICE", AuthStages{
+		AuthPassword: PasswordAuth(bot.UserId, "password"),
+	}))
+	assert.Equal(t, 2, requests)
+}
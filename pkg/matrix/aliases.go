@@ -0,0 +1,151 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/room_directory"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// How long a resolved room alias is trusted before it is looked up again.
+const aliasCacheTTL = 10 * time.Minute
+
+type cachedAlias struct {
+	roomId  string
+	expires time.Time
+}
+
+// Get the room ID of a room given as a room ID, a room alias such as #ops:example.org,
+// a https://matrix.to/#/ link or a matrix: URI. Aliases are looked up in the room
+// directory and cached for a while.
+func (b *Bot) ResolveRoom(c context.Context, room string) (string, error) {
+	room, err := parseRoomURI(room)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(room, "!") {
+		return room, nil
+	}
+
+	b.lock.Lock()
+	cached, ok := b.roomAliases[room]
+	b.lock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.roomId, nil
+	}
+
+	params := room_directory.NewGetRoomIDByAliasParamsWithContext(c)
+	params.SetRoomAlias(room)
+
+	result, err := b.client.RoomDirectory.GetRoomIDByAlias(params)
+	if err != nil {
+		return "", fmt.Errorf("Could not resolve %s: %w", room, err)
+	}
+
+	if result.Payload.RoomID == "" {
+		return "", fmt.Errorf("Could not resolve %s: no room ID returned", room)
+	}
+
+	b.lock.Lock()
+	b.roomAliases[room] = cachedAlias{
+		roomId:  result.Payload.RoomID,
+		expires: time.Now().Add(aliasCacheTTL),
+	}
+	b.lock.Unlock()
+
+	return result.Payload.RoomID, nil
+}
+
+// Point a room alias, such as #ops:example.org, at a room.
+func (b *Bot) SetRoomAlias(c context.Context, alias, room_id string) error {
+	params := room_directory.NewSetRoomAliasParamsWithContext(c)
+	params.SetRoomAlias(alias)
+	params.SetBody(&models.SetRoomAliasParamsBody{
+		RoomID: &room_id,
+	})
+
+	if _, err := b.client.RoomDirectory.SetRoomAlias(params, b); err != nil {
+		return fmt.Errorf("Could not set alias %s: %w", alias, err)
+	}
+
+	b.lock.Lock()
+	b.roomAliases[alias] = cachedAlias{
+		roomId:  room_id,
+		expires: time.Now().Add(aliasCacheTTL),
+	}
+	b.lock.Unlock()
+
+	return nil
+}
+
+// Remove a room alias from the room directory.
+func (b *Bot) DeleteRoomAlias(c context.Context, alias string) error {
+	params := room_directory.NewDeleteRoomAliasParamsWithContext(c)
+	params.SetRoomAlias(alias)
+
+	if _, err := b.client.RoomDirectory.DeleteRoomAlias(params, b); err != nil {
+		return fmt.Errorf("Could not delete alias %s: %w", alias, err)
+	}
+
+	b.lock.Lock()
+	delete(b.roomAliases, alias)
+	b.lock.Unlock()
+
+	return nil
+}
+
+// Get the room ID or alias a matrix.to link or matrix: URI points at, ignoring any event
+// or via servers in it. Room IDs and aliases are returned as is.
+func parseRoomURI(room string) (string, error) {
+	var id string
+
+	switch {
+	case strings.HasPrefix(room, "!") || strings.HasPrefix(room, "#"):
+		id = room
+	case strings.HasPrefix(room, "https://matrix.to/"):
+		uri, err := url.Parse(room)
+		if err != nil {
+			return "", fmt.Errorf("Invalid matrix.to link %s: %s", room, err)
+		}
+
+		id = strings.TrimPrefix(uri.Fragment, "/")
+		id = strings.SplitN(id, "?", 2)[0]
+		id = strings.SplitN(id, "/", 2)[0]
+	case strings.HasPrefix(room, "matrix:"):
+		uri, err := url.Parse(room)
+		if err != nil {
+			return "", fmt.Errorf("Invalid matrix URI %s: %s", room, err)
+		}
+
+		parts := strings.Split(uri.Opaque, "/")
+		if len(parts) < 2 {
+			return "", fmt.Errorf("Invalid matrix URI %s", room)
+		}
+
+		id, err = url.PathUnescape(parts[1])
+		if err != nil {
+			return "", fmt.Errorf("Invalid matrix URI %s: %s", room, err)
+		}
+
+		switch parts[0] {
+		case "r":
+			id = "#" + id
+		case "roomid":
+			id = "!" + id
+		default:
+			return "", fmt.Errorf("Matrix URI %s does not point at a room", room)
+		}
+	}
+
+	if !strings.HasPrefix(id, "!") && !strings.HasPrefix(id, "#") || !strings.Contains(id, ":") {
+		return "", fmt.Errorf("Not a room ID or alias: %s", room)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,86 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveRoom(t *testing.T) {
+	lookups := 0
+	aliases := map[string]string{
+		"#ops:example.org": "!ops:example.org",
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		alias := r.URL.Path[len("/_matrix/client/unstable/directory/room/"):]
+
+		switch r.Method {
+		case "PUT":
+			body := map[string]string{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			aliases[alias] = body["room_id"]
+			fmt.Fprint(w, `{}`)
+		case "DELETE":
+			delete(aliases, alias)
+			fmt.Fprint(w, `{}`)
+		default:
+			lookups++
+
+			room_id, ok := aliases[alias]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errcode": "M_NOT_FOUND", "error": "Room alias not found"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"room_id": "%s", "servers": ["example.org"]}`, room_id)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	for _, room := range []string{
+		"!ops:example.org",
+		"#ops:example.org",
+		"https://matrix.to/#/#ops:example.org",
+		"https://matrix.to/#/%23ops%3Aexample.org?via=example.org",
+		"https://matrix.to/#/!ops:example.org/$event?via=example.org",
+		"matrix:r/ops:example.org",
+		"matrix:roomid/ops:example.org?via=example.org",
+		"matrix:roomid/ops:example.org/e/event",
+	} {
+		room_id, err := bot.ResolveRoom(context.TODO(), room)
+		assert.Nil(t, err, room)
+		assert.Equal(t, "!ops:example.org", room_id, room)
+	}
+
+	// The alias is only looked up once.
+	assert.Equal(t, 1, lookups)
+
+	for _, room := range []string{"ops:example.org", "#ops", "matrix:u/alice:example.org", "https://matrix.to/#/@alice:example.org"} {
+		_, err := bot.ResolveRoom(context.TODO(), room)
+		assert.NotNil(t, err, room)
+	}
+
+	_, err := bot.ResolveRoom(context.TODO(), "#missing:example.org")
+	assert.Equal(t, "M_NOT_FOUND", ErrCode(err))
+
+	assert.Nil(t, bot.SetRoomAlias(context.TODO(), "#alerts:example.org", "!alerts:example.org"))
+	assert.Equal(t, "!alerts:example.org", aliases["#alerts:example.org"])
+
+	room_id, err := bot.ResolveRoom(context.TODO(), "#alerts:example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, "!alerts:example.org", room_id)
+
+	assert.Nil(t, bot.DeleteRoomAlias(context.TODO(), "#alerts:example.org"))
+	_, err = bot.ResolveRoom(context.TODO(), "#alerts:example.org")
+	assert.Equal(t, "M_NOT_FOUND", ErrCode(err))
+}
@@ -0,0 +1,267 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+	"github.com/justinbarrick/go-matrix/pkg/client/session_management"
+	libolm "github.com/justinbarrick/libolm-go"
+)
+
+// Called when the server soft logged out the bot and its access token cannot be
+// refreshed. It should log in again, for example with Login, which keeps the bot's
+// device and encryption keys.
+type SoftLogoutHandler func(c context.Context, b *Bot) error
+
+type loginResponse struct {
+	UserId       string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	DeviceId     string `json:"device_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Sends requests with an access token other than the bot's, such as an appservice's.
+type bearerToken string
+
+func (t bearerToken) AuthenticateRequest(request runtime.ClientRequest, registry strfmt.Registry) error {
+	return request.SetHeaderParam("Authorization", "Bearer "+string(t))
+}
+
+// Log in with the given login body, authenticating the request with auth if it is not
+// nil. A refresh token is requested so that an expired
+// access token can be replaced without logging in again. If the bot already has a
+// device it is logged in again and keeps its Olm account.
+func (b *Bot) login(c context.Context, auth runtime.ClientAuthInfoWriter, body map[string]interface{}) error {
+	b.lock.Lock()
+	deviceId := b.DeviceId
+	b.lock.Unlock()
+
+	body["refresh_token"] = true
+	if deviceId != "" {
+		body["device_id"] = deviceId
+	}
+
+	result := loginResponse{}
+	if err := b.submitJSON(c, auth, "POST", "/login", body, &result); err != nil {
+		return fmt.Errorf("Could not login: %w", err)
+	}
+
+	b.lock.Lock()
+	sameDevice := b.Olm != nil && result.DeviceId == b.DeviceId
+	b.UserId = result.UserId
+	b.DeviceId = result.DeviceId
+	b.AccessToken = result.AccessToken
+	b.RefreshToken = result.RefreshToken
+	if !sameDevice {
+		b.Olm = libolm.NewMatrix()
+	}
+	b.lock.Unlock()
+
+	if sameDevice {
+		return nil
+	}
+
+	return b.UploadKeys(c)
+}
+
+// Log in with a login token, such as the one the server hands out after single sign-on.
+func (b *Bot) LoginWithToken(c context.Context, token string) error {
+	return b.login(c, nil, map[string]interface{}{
+		"type":  "m.login.token",
+		"token": token,
+	})
+}
+
+// Log in as a user in an application service's namespace with the appservice's as_token.
+func (b *Bot) LoginAppService(c context.Context, asToken, username string) error {
+	return b.login(c, bearerToken(asToken), map[string]interface{}{
+		"type": "m.login.application_service",
+		"identifier": map[string]string{
+			"type": "m.id.user",
+			"user": username,
+		},
+	})
+}
+
+// The URL to send a browser to to log in with the server's single sign-on. The server
+// redirects it to redirectUrl with a loginToken query parameter afterwards.
+func (b *Bot) SSOLoginURL(redirectUrl string) (string, error) {
+	serverUrl, err := parseServerUrl(b.Server)
+	if err != nil {
+		return "", err
+	}
+
+	serverUrl.Path = path.Join(serverUrl.Path, "/_matrix/client/unstable/login/sso/redirect")
+	serverUrl.RawQuery = url.Values{"redirectUrl": []string{redirectUrl}}.Encode()
+	return serverUrl.String(), nil
+}
+
+// Log in with the server's single sign-on. open is called with the URL the user needs to
+// visit in a browser, a listener on a loopback port receives the login token that the
+// server redirects the browser back with.
+func (b *Bot) LoginWithSSO(c context.Context, open func(url string) error) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("Could not listen for the SSO redirect: %s", err)
+	}
+
+	tokens := make(chan string, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.URL.Query().Get("loginToken")
+			if token == "" {
+				http.Error(w, "No login token in the redirect.", http.StatusBadRequest)
+				return
+			}
+
+			fmt.Fprint(w, "Received the login token, you can close this window.")
+			select {
+			case tokens <- token:
+			default:
+			}
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	loginUrl, err := b.SSOLoginURL(fmt.Sprintf("http://%s/", listener.Addr()))
+	if err != nil {
+		return err
+	}
+
+	if err := open(loginUrl); err != nil {
+		return err
+	}
+
+	select {
+	case token := <-tokens:
+		return b.LoginWithToken(c, token)
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// The login types the server supports, such as m.login.password and m.login.sso.
+func (b *Bot) LoginFlows(c context.Context) ([]string, error) {
+	flows, err := b.client.SessionManagement.GetLoginFlows(session_management.NewGetLoginFlowsParamsWithContext(c))
+	if err != nil {
+		return nil, fmt.Errorf("Could not get login flows: %w", err)
+	}
+
+	types := []string{}
+	for _, flow := range flows.Payload.Flows {
+		types = append(types, flow.Type)
+	}
+
+	return types, nil
+}
+
+// Replace the access token with a new one using the refresh token.
+func (b *Bot) RefreshAccessToken(c context.Context) error {
+	b.lock.Lock()
+	refreshToken := b.RefreshToken
+	b.lock.Unlock()
+
+	if refreshToken == "" {
+		return fmt.Errorf("No refresh token, please login.")
+	}
+
+	result := loginResponse{}
+	err := b.doUnauthenticatedJSON(c, "POST", "/refresh", map[string]string{
+		"refresh_token": refreshToken,
+	}, &result)
+	if err != nil {
+		return fmt.Errorf("Could not refresh access token: %w", err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.AccessToken = result.AccessToken
+	// The server may keep using the same refresh token.
+	if result.RefreshToken != "" {
+		b.RefreshToken = result.RefreshToken
+	}
+
+	return nil
+}
+
+// Register a function to be called to log in again when the server soft logged out the
+// bot and its access token cannot be refreshed.
+func (b *Bot) OnSoftLogout(handler SoftLogoutHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.softLogoutHandler = handler
+}
+
+// Get a new access token after a request that used failedToken was rejected because the
+// bot was soft logged out, by refreshing it or calling the soft logout handler. Requests
+// that fail at the same time only re-authenticate once.
+func (b *Bot) reauthenticate(c context.Context, failedToken string) error {
+	b.authLock.Lock()
+	defer b.authLock.Unlock()
+
+	b.lock.Lock()
+	accessToken, refreshToken, handler := b.AccessToken, b.RefreshToken, b.softLogoutHandler
+	b.lock.Unlock()
+
+	if accessToken != failedToken {
+		return nil
+	}
+
+	err := fmt.Errorf("No refresh token or soft logout handler")
+	if refreshToken != "" {
+		err = b.RefreshAccessToken(c)
+	}
+
+	if err != nil && handler != nil {
+		err = handler(c, b)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// A config that cannot be written, such as one mounted from a secret, keeps the new
+	// tokens in memory until the bot restarts.
+	b.saveConfig()
+	return nil
+}
+
+// Set the store that the bot's credentials are saved to when they change, encrypted
+// with key unless it is empty.
+func (b *Bot) SetConfigStore(store ConfigStore, key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.configStore = store
+	b.configKey = key
+}
+
+// Save the bot's credentials to its config store, if it has one.
+func (b *Bot) saveConfig() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.configStore == nil {
+		return nil
+	}
+
+	data, err := encodeBot(*b, b.configKey)
+	if err != nil {
+		return err
+	}
+
+	if err := b.configStore.SaveConfig(data); err != nil {
+		return fmt.Errorf("Could not save config: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	libolm "github.com/justinbarrick/libolm-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const softLogoutResponse = `{"errcode": "M_UNKNOWN_TOKEN", "error": "Access token has expired", "soft_logout": true}`
+
+func TestAccessTokenInHeader(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "", r.URL.Query().Get("access_token"))
+		fmt.Fprint(w, `{"next_batch": "s1"}`)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	refreshes := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/refresh":
+			refreshes++
+			body := map[string]string{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "refresh1", body["refresh_token"])
+			assert.Equal(t, "", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `{"access_token": "token2", "refresh_token": "refresh2", "expires_in_ms": 60000}`)
+		case "/_matrix/client/unstable/sync":
+			if r.Header.Get("Authorization") != "Bearer token2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, softLogoutResponse)
+				return
+			}
+			fmt.Fprint(w, `{"next_batch": "s1"}`)
+		}
+	}))
+	defer server.Close()
+
+	store := NewMemoryStore()
+
+	bot := newTestBot(t, server)
+	bot.RefreshToken = "refresh1"
+	bot.SetConfigStore(store, "")
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+	assert.Equal(t, 1, refreshes)
+	assert.Equal(t, "token2", bot.AccessToken)
+	assert.Equal(t, "refresh2", bot.RefreshToken)
+
+	// The new tokens were saved.
+	config, err := store.LoadConfig()
+	assert.Nil(t, err)
+	saved := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(config, &saved))
+	assert.Equal(t, "token2", saved["accessToken"])
+	assert.Equal(t, "refresh2", saved["refreshToken"])
+}
+
+func TestSoftLogoutLogsInAgain(t *testing.T) {
+	logins := []map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/login":
+			body := map[string]interface{}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			logins = append(logins, body)
+			fmt.Fprint(w, `{"user_id": "@bot:example.org", "access_token": "token2", "device_id": "BOTDEVICE", "refresh_token": "refresh2"}`)
+		case "/_matrix/client/unstable/sync":
+			if r.Header.Get("Authorization") != "Bearer token2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, softLogoutResponse)
+				return
+			}
+			fmt.Fprint(w, `{"next_batch": "s1"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	olm := libolm.NewMatrix()
+	bot.Olm = olm
+
+	// Without a refresh token or handler the error is returned.
+	err := bot.SyncOnce(context.TODO())
+	assert.Equal(t, "M_UNKNOWN_TOKEN", ErrCode(err))
+
+	bot.OnSoftLogout(func(c context.Context, b *Bot) error {
+		return b.Login(c, b.UserId, "password")
+	})
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	// The bot logged in again as the same device and kept its Olm account.
+	assert.Equal(t, 1, len(logins))
+	assert.Equal(t, "BOTDEVICE", logins[0]["device_id"])
+	assert.Equal(t, true, logins[0]["refresh_token"])
+	assert.Equal(t, "token2", bot.AccessToken)
+	assert.Equal(t, "refresh2", bot.RefreshToken)
+	assert.Equal(t, olm, bot.Olm)
+}
+
+func TestLoginTypes(t *testing.T) {
+	logins := []map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/login":
+			if r.Method == "GET" {
+				fmt.Fprint(w, `{"flows": [{"type": "m.login.password"}, {"type": "m.login.sso"}, {"type": "m.login.token"}]}`)
+				return
+			}
+
+			body := map[string]interface{}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			body["authorization"] = r.Header.Get("Authorization")
+			logins = append(logins, body)
+			fmt.Fprint(w, `{"user_id": "@bot:example.org", "access_token": "token2", "device_id": "NEWDEVICE"}`)
+		case "/_matrix/client/unstable/keys/upload":
+			fmt.Fprint(w, `{"one_time_key_counts": {}}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.DeviceId = ""
+
+	flows, err := bot.LoginFlows(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"m.login.password", "m.login.sso", "m.login.token"}, flows)
+
+	// The browser is sent to the server, which redirects it back with a login token.
+	err = bot.LoginWithSSO(context.TODO(), func(loginUrl string) error {
+		parsed, err := url.Parse(loginUrl)
+		assert.Nil(t, err)
+		assert.Equal(t, "/_matrix/client/unstable/login/sso/redirect", parsed.Path)
+
+		resp, err := http.Get(parsed.Query().Get("redirectUrl") + "?loginToken=sso-token")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Body.Close()
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "token2", bot.AccessToken)
+	assert.Equal(t, "NEWDEVICE", bot.DeviceId)
+
+	assert.Nil(t, bot.LoginAppService(context.TODO(), "as-token", "bridge_user"))
+
+	assert.Equal(t, 2, len(logins))
+	assert.Equal(t, "m.login.token", logins[0]["type"])
+	assert.Equal(t, "sso-token", logins[0]["token"])
+	assert.Equal(t, "", logins[0]["authorization"])
+	assert.Equal(t, "m.login.application_service", logins[1]["type"])
+	assert.Equal(t, map[string]interface{}{"type": "m.id.user", "user": "bridge_user"}, logins[1]["identifier"])
+	assert.Equal(t, "Bearer as-token", logins[1]["authorization"])
+	// The second login is for the same device, which keeps its keys.
+	assert.Equal(t, "NEWDEVICE", logins[1]["device_id"])
+}
@@ -0,0 +1,423 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+)
+
+const backupAlgorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+
+// The server-side key backup that room keys are uploaded to.
+type KeyBackup struct {
+	Version string `json:"version"`
+	// The curve25519 private key that backed up sessions are encrypted to.
+	PrivateKey []byte `json:"privateKey"`
+}
+
+// A session as stored in the key backup, session_data is encrypted.
+type backedUpSession struct {
+	FirstMessageIndex uint32                 `json:"first_message_index"`
+	ForwardedCount    int                    `json:"forwarded_count"`
+	IsVerified        bool                   `json:"is_verified"`
+	SessionData       map[string]interface{} `json:"session_data"`
+}
+
+type backupRooms struct {
+	Rooms map[string]struct {
+		Sessions map[string]backedUpSession `json:"sessions"`
+	} `json:"rooms"`
+}
+
+// The keys used to encrypt a session for the backup, derived from the shared secret of an
+// ephemeral key and the backup key.
+func backupKeys(secret []byte) (aesKey, macKey, iv []byte) {
+	keys := hkdfSHA256(secret, nil, nil, 80)
+	return keys[:32], keys[32:64], keys[64:]
+}
+
+// Encrypt a session to the backup's public key.
+func encryptForBackup(publicKey *ecdh.PublicKey, plaintext []byte) (map[string]interface{}, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate ephemeral key: %s", err)
+	}
+
+	secret, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive shared secret: %s", err)
+	}
+
+	aesKey, macKey, iv := backupKeys(secret)
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return map[string]interface{}{
+		"ephemeral":  base64.RawStdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		"ciphertext": base64.RawStdEncoding.EncodeToString(ciphertext),
+		"mac":        base64.RawStdEncoding.EncodeToString(backupMac(macKey)),
+	}, nil
+}
+
+// libolm computes the MAC over an empty string rather than the ciphertext, and every
+// client has to do the same to stay compatible.
+func backupMac(macKey []byte) []byte {
+	return hmac.New(sha256.New, macKey).Sum(nil)[:8]
+}
+
+// Decrypt a session from the backup with the backup's private key.
+func decryptFromBackup(privateKey *ecdh.PrivateKey, sessionData map[string]interface{}) ([]byte, error) {
+	decoded := map[string][]byte{}
+	for _, field := range []string{"ephemeral", "ciphertext", "mac"} {
+		value, err := decodeBase64(contentString(sessionData, field))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode %s: %s", field, err)
+		}
+		decoded[field] = value
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(decoded["ephemeral"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ephemeral key: %s", err)
+	}
+
+	secret, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive shared secret: %s", err)
+	}
+
+	aesKey, macKey, iv := backupKeys(secret)
+	if !hmac.Equal(backupMac(macKey), decoded["mac"]) {
+		return nil, fmt.Errorf("Bad MAC")
+	}
+
+	ciphertext := decoded["ciphertext"]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length")
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("Invalid padding")
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// Export an inbound group session in the format shared by key backups and key exports.
+func exportSession(key, claimedKey string, session *megolm.InboundSession) (roomId, sessionId string, exported map[string]interface{}, err error) {
+	parts := strings.SplitN(key, "|", 3)
+	roomId, senderKey, sessionId := parts[0], parts[1], parts[2]
+
+	sessionKey, err := session.Export(session.FirstKnownIndex())
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Could not export session %s: %s", sessionId, err)
+	}
+
+	claimedKeys := map[string]string{}
+	if claimedKey != "" {
+		claimedKeys["ed25519"] = claimedKey
+	}
+
+	return roomId, sessionId, map[string]interface{}{
+		"algorithm":                       megolmAlgorithm,
+		"sender_key":                      senderKey,
+		"session_key":                     sessionKey,
+		"sender_claimed_keys":             claimedKeys,
+		"forwarding_curve25519_key_chain": []string{},
+	}, nil
+}
+
+// Add a session exported by exportSession or another client and return its key in the
+// inbound group sessions.
+func (b *Bot) importSession(roomId, sessionId string, exported map[string]interface{}) (string, error) {
+	if algorithm := contentString(exported, "algorithm"); algorithm != megolmAlgorithm {
+		return "", fmt.Errorf("Unsupported session algorithm: %s", algorithm)
+	}
+
+	session, err := megolm.ImportInboundSession(contentString(exported, "session_key"))
+	if err != nil {
+		return "", err
+	}
+
+	if session.GetSessionID() != sessionId {
+		return "", fmt.Errorf("Session %s has the wrong session key", sessionId)
+	}
+
+	senderKey := contentString(exported, "sender_key")
+	claimedKey := ""
+	if claimedKeys, ok := exported["sender_claimed_keys"].(map[string]interface{}); ok {
+		claimedKey = contentString(claimedKeys, "ed25519")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.addInboundGroupSession(roomId, senderKey, claimedKey, session)
+	return groupSessionKey(roomId, senderKey, sessionId), nil
+}
+
+// Create a new backup version on the server and start uploading room keys to it. The
+// returned recovery key is needed to restore the backup and is not stored on the server.
+func (b *Bot) CreateKeyBackup(c context.Context) (string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("Could not generate backup key: %s", err)
+	}
+
+	authData := map[string]interface{}{
+		"public_key": base64.RawStdEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+	}
+
+	if err := b.signBackupAuthData(authData); err != nil {
+		return "", err
+	}
+
+	result := struct {
+		Version string `json:"version"`
+	}{}
+
+	err = b.doJSON(c, "POST", "/room_keys/version", map[string]interface{}{
+		"algorithm": backupAlgorithm,
+		"auth_data": authData,
+	}, &result)
+	if err != nil {
+		return "", fmt.Errorf("Could not create key backup: %w", err)
+	}
+
+	b.lock.Lock()
+	b.keyBackup = &KeyBackup{Version: result.Version, PrivateKey: privateKey.Bytes()}
+	b.backedUpSessions = map[string]bool{}
+	b.lock.Unlock()
+
+	if err := b.saveCryptoState(); err != nil {
+		return "", err
+	}
+
+	if err := b.BackupRoomKeys(c); err != nil {
+		return "", err
+	}
+
+	return encodeRecoveryKey(privateKey.Bytes()), nil
+}
+
+// Sign a backup's auth_data with our device key and our master key, if we have them.
+func (b *Bot) signBackupAuthData(authData map[string]interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.Olm != nil {
+		signature, err := b.Olm.SignObj(authData)
+		if err != nil {
+			return fmt.Errorf("Could not sign backup: %s", err)
+		}
+
+		authData["signatures"] = map[string]map[string]string{
+			b.UserId: {"ed25519:" + b.DeviceId: signature},
+		}
+	}
+
+	if b.crossSigningKeys != nil && !b.crossSigningKeys.Pending {
+		master := b.crossSigningKeys.Master
+		if err := signJSON(authData, b.UserId, "ed25519:"+encodePublicKey(master), master); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore the room keys in the server's current backup version with a recovery key
+// and keep uploading new room keys to it. Returns the number of sessions restored.
+func (b *Bot) RestoreKeyBackup(c context.Context, recoveryKey string) (int, error) {
+	decoded, err := decodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return 0, err
+	}
+
+	privateKey, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid recovery key: %s", err)
+	}
+
+	version := struct {
+		Algorithm string                 `json:"algorithm"`
+		AuthData  map[string]interface{} `json:"auth_data"`
+		Version   string                 `json:"version"`
+	}{}
+
+	if err := b.doJSON(c, "GET", "/room_keys/version", nil, &version); err != nil {
+		return 0, fmt.Errorf("Could not get key backup version: %w", err)
+	}
+
+	if version.Algorithm != backupAlgorithm {
+		return 0, fmt.Errorf("Unsupported key backup algorithm: %s", version.Algorithm)
+	}
+
+	publicKey := base64.RawStdEncoding.EncodeToString(privateKey.PublicKey().Bytes())
+	if strings.TrimRight(contentString(version.AuthData, "public_key"), "=") != publicKey {
+		return 0, fmt.Errorf("Recovery key does not match key backup version %s", version.Version)
+	}
+
+	backup := backupRooms{}
+	if err := b.doJSON(c, "GET", "/room_keys/keys?version="+url.QueryEscape(version.Version), nil, &backup); err != nil {
+		return 0, fmt.Errorf("Could not download key backup: %w", err)
+	}
+
+	b.lock.Lock()
+	b.keyBackup = &KeyBackup{Version: version.Version, PrivateKey: decoded}
+	b.backedUpSessions = map[string]bool{}
+	b.lock.Unlock()
+
+	restored := 0
+	for roomId, room := range backup.Rooms {
+		for sessionId, backedUp := range room.Sessions {
+			plaintext, err := decryptFromBackup(privateKey, backedUp.SessionData)
+			if err != nil {
+				return restored, fmt.Errorf("Could not decrypt session %s: %s", sessionId, err)
+			}
+
+			sessionData := map[string]interface{}{}
+			if err := json.Unmarshal(plaintext, &sessionData); err != nil {
+				return restored, fmt.Errorf("Could not decode session %s: %s", sessionId, err)
+			}
+
+			key, err := b.importSession(roomId, sessionId, sessionData)
+			if err != nil {
+				return restored, err
+			}
+
+			b.lock.Lock()
+			b.backedUpSessions[key] = true
+			b.lock.Unlock()
+			restored++
+		}
+	}
+
+	return restored, b.saveCryptoState()
+}
+
+// Upload the inbound group sessions that are not in the key backup yet. Does nothing if
+// no backup has been created or restored. If the backup has been deleted or replaced on
+// the server it is forgotten, so that a new one can be created or restored.
+func (b *Bot) BackupRoomKeys(c context.Context) error {
+	b.lock.Lock()
+	keyBackup := b.keyBackup
+	b.lock.Unlock()
+
+	if keyBackup == nil {
+		return nil
+	}
+
+	privateKey, err := ecdh.X25519().NewPrivateKey(keyBackup.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Invalid backup key: %s", err)
+	}
+
+	rooms, pending, err := b.pendingBackupSessions(privateKey.PublicKey())
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err = b.doJSON(c, "PUT", "/room_keys/keys?version="+url.QueryEscape(keyBackup.Version), map[string]interface{}{
+		"rooms": rooms,
+	}, nil)
+	if errCode := ErrCode(err); errCode == "M_NOT_FOUND" || errCode == "M_WRONG_ROOM_KEYS_VERSION" {
+		b.lock.Lock()
+		if b.keyBackup == keyBackup {
+			b.keyBackup = nil
+		}
+		b.lock.Unlock()
+
+		if err := b.saveCryptoState(); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not back up room keys: %w", err)
+	}
+
+	b.lock.Lock()
+	for _, key := range pending {
+		b.backedUpSessions[key] = true
+	}
+	b.lock.Unlock()
+
+	return b.saveCryptoState()
+}
+
+// Encrypt the inbound group sessions that are not in the key backup yet for upload,
+// returning them by room ID and their keys in the inbound group sessions.
+func (b *Bot) pendingBackupSessions(publicKey *ecdh.PublicKey) (map[string]map[string]map[string]backedUpSession, []string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	rooms := map[string]map[string]map[string]backedUpSession{}
+	pending := []string{}
+
+	for key, session := range b.inboundGroupSessions {
+		if b.backedUpSessions[key] {
+			continue
+		}
+
+		roomId, sessionId, exported, err := exportSession(key, b.senderClaimedKeys[key], session)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		plaintext, err := json.Marshal(exported)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sessionData, err := encryptForBackup(publicKey, plaintext)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rooms[roomId] == nil {
+			rooms[roomId] = map[string]map[string]backedUpSession{"sessions": {}}
+		}
+
+		rooms[roomId]["sessions"][sessionId] = backedUpSession{
+			FirstMessageIndex: session.FirstKnownIndex(),
+			IsVerified:        session.Verified(),
+			SessionData:       sessionData,
+		}
+		pending = append(pending, key)
+	}
+
+	return rooms, pending, nil
+}
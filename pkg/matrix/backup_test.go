@@ -0,0 +1,117 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	privateKey := make([]byte, 32)
+	for i := range privateKey {
+		privateKey[i] = byte(i)
+	}
+
+	recoveryKey := encodeRecoveryKey(privateKey)
+	assert.True(t, strings.HasPrefix(recoveryKey, "Es"))
+
+	decoded, err := decodeRecoveryKey(recoveryKey)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey, decoded)
+
+	_, err = decodeRecoveryKey(strings.Replace(recoveryKey, recoveryKey[5:6], "z", 1))
+	assert.NotNil(t, err)
+}
+
+func TestKeyBackupRoundTrip(t *testing.T) {
+	var backupVersion map[string]interface{}
+	backup := map[string]interface{}{}
+	uploads := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/room_keys/version":
+			if r.Method == "POST" {
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(&backupVersion))
+				backupVersion["version"] = "1"
+				w.Write([]byte(`{"version": "1"}`))
+			} else {
+				json.NewEncoder(w).Encode(backupVersion)
+			}
+		case "/_matrix/client/unstable/room_keys/keys":
+			assert.Equal(t, "1", r.URL.Query().Get("version"))
+			if r.Method == "PUT" {
+				uploads++
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(&backup))
+				w.Write([]byte(`{"etag": "1", "count": 1}`))
+			} else {
+				json.NewEncoder(w).Encode(backup)
+			}
+		}
+	}))
+	defer server.Close()
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	bot := newTestBot(t, server)
+	bot.addInboundGroupSession("!room:example.org", "alicekey", "", inbound)
+
+	recoveryKey, err := bot.CreateKeyBackup(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, backupAlgorithm, backupVersion["algorithm"])
+	assert.Equal(t, 1, uploads)
+
+	// Sessions are only uploaded once.
+	assert.Nil(t, bot.BackupRoomKeys(context.TODO()))
+	assert.Equal(t, 1, uploads)
+
+	restored := newTestBot(t, server)
+	count, err := restored.RestoreKeyBackup(context.TODO(), recoveryKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	_, ciphertext := outbound.Encrypt("hello")
+	key := groupSessionKey("!room:example.org", "alicekey", outbound.GetSessionID())
+	plaintext, _, err := restored.inboundGroupSessions[key].Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", plaintext)
+
+	_, err = restored.RestoreKeyBackup(context.TODO(), encodeRecoveryKey(make([]byte, 32)))
+	assert.NotNil(t, err)
+}
+
+func TestKeyBackupVersionRemoved(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errcode": "M_WRONG_ROOM_KEYS_VERSION", "current_version": "2"}`))
+	}))
+	defer server.Close()
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	bot := newTestBot(t, server)
+	bot.addInboundGroupSession("!room:example.org", "alicekey", "", inbound)
+	bot.keyBackup = &KeyBackup{Version: "1", PrivateKey: make([]byte, 32)}
+
+	err = bot.BackupRoomKeys(context.TODO())
+	assert.Equal(t, "M_WRONG_ROOM_KEYS_VERSION", ErrCode(err))
+	assert.Nil(t, bot.keyBackup)
+
+	// Without a backup there is nothing to upload.
+	assert.Nil(t, bot.BackupRoomKeys(context.TODO()))
+}
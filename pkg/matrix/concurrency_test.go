@@ -0,0 +1,124 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	libolm "github.com/justinbarrick/libolm-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run with -race to check that sends to several rooms and sync can share a bot.
+func TestConcurrentSends(t *testing.T) {
+	rooms := []string{"!one:example.org", "!two:example.org", "!three:example.org"}
+	messages := 10
+
+	aliceDevices := models.QueryKeysOKBodyDeviceKeysAdditionalProperties{
+		"PHONE": signedDeviceKeys(t, "@alice:example.org", "PHONE", newSigningKey(t)),
+	}
+
+	lock := sync.Mutex{}
+	sent := map[string][]map[string]string{}
+	syncs := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/unstable")
+		switch {
+		case path == "/sync":
+			lock.Lock()
+			syncs++
+			fmt.Fprintf(w, `{"next_batch": "s%d", "device_lists": {"changed": ["@alice:example.org"]}}`, syncs)
+			lock.Unlock()
+		case path == "/keys/query":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_keys": map[string]interface{}{"@alice:example.org": aliceDevices},
+			})
+		case path == "/keys/claim":
+			fmt.Fprint(w, `{"one_time_keys": {"@alice:example.org": {"PHONE": {"signed_curve25519:AAAA": {"key": "onetimekey"}}}}}`)
+		case strings.HasPrefix(path, "/sendToDevice/"):
+			fmt.Fprint(w, `{}`)
+		case strings.HasSuffix(path, "/joined_members"):
+			fmt.Fprint(w, `{"joined": {"@alice:example.org": {}}}`)
+		case strings.HasSuffix(path, "/state/m.room.encryption"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_NOT_FOUND"}`)
+		case strings.Contains(path, "/send/m.room.encrypted/"):
+			event := map[string]string{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+
+			roomId := strings.Split(path, "/")[2]
+			lock.Lock()
+			sent[roomId] = append(sent[roomId], event)
+			lock.Unlock()
+
+			fmt.Fprint(w, `{"event_id": "$event"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_UNRECOGNIZED"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.Olm = libolm.NewMatrix()
+	assert.Nil(t, bot.SetCryptoStore(NewMemoryStore()))
+
+	wg := sync.WaitGroup{}
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				assert.Nil(t, bot.SyncOnce(context.TODO()))
+			}
+		}
+	}()
+
+	sends := sync.WaitGroup{}
+	for _, roomId := range rooms {
+		for i := 0; i < messages; i++ {
+			sends.Add(1)
+			go func(roomId string, i int) {
+				defer sends.Done()
+				assert.Nil(t, bot.SendEncryptedEvent(context.TODO(), roomId, "m.room.message", map[string]string{
+					"body": fmt.Sprintf("%d", i),
+				}))
+			}(roomId, i)
+		}
+	}
+
+	sends.Wait()
+	close(done)
+	wg.Wait()
+
+	// Each room's events arrived in the order of their message indexes.
+	for _, roomId := range rooms {
+		assert.Equal(t, messages, len(sent[roomId]))
+
+		for i, event := range sent[roomId] {
+			key := groupSessionKey(roomId, event["sender_key"], event["session_id"])
+			session, ok := bot.inboundGroupSessions[key]
+			if !assert.True(t, ok) {
+				continue
+			}
+
+			_, index, err := session.Decrypt(event["ciphertext"])
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(i), index)
+		}
+	}
+}
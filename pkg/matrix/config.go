@@ -0,0 +1,252 @@
+package matrix
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	configAlgorithm = "pbkdf2-sha512-aes-256-gcm"
+	configRounds    = 200000
+)
+
+// An encrypted configuration file.
+type encryptedConfig struct {
+	Encrypted struct {
+		Algorithm  string `json:"algorithm"`
+		Salt       string `json:"salt"`
+		Rounds     int    `json:"rounds"`
+		Nonce      string `json:"nonce"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"encrypted"`
+}
+
+// Return the key that configuration files are encrypted with, read from
+// $MATRIX_CONFIG_KEY or the file named by $MATRIX_CONFIG_KEY_FILE. Returns an empty
+// string if neither is set.
+func ConfigKey() (string, error) {
+	if key := os.Getenv("MATRIX_CONFIG_KEY"); key != "" {
+		return key, nil
+	}
+
+	path := os.Getenv("MATRIX_CONFIG_KEY_FILE")
+	if path == "" {
+		return "", nil
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read config key: %s", err)
+	}
+
+	return strings.TrimSpace(string(key)), nil
+}
+
+func configCipher(key string, salt []byte, rounds int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(key), salt, rounds, 32, sha512.New))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypts data with a key derived from the config key once, so that state that is
+// saved often does not pay for the key derivation every time.
+type configSealer struct {
+	salt   []byte
+	rounds int
+	aead   cipher.AEAD
+}
+
+func newConfigSealer(key string) (*configSealer, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := configCipher(key, salt, configRounds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &configSealer{salt: salt, rounds: configRounds, aead: aead}, nil
+}
+
+func (s *configSealer) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	config := encryptedConfig{}
+	config.Encrypted.Algorithm = configAlgorithm
+	config.Encrypted.Salt = base64.StdEncoding.EncodeToString(s.salt)
+	config.Encrypted.Rounds = s.rounds
+	config.Encrypted.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	config.Encrypted.Ciphertext = base64.StdEncoding.EncodeToString(s.aead.Seal(nil, nonce, plaintext, nil))
+
+	return json.Marshal(config)
+}
+
+func encryptConfig(plaintext []byte, key string) ([]byte, error) {
+	sealer, err := newConfigSealer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealer.seal(plaintext)
+}
+
+// Decrypt a configuration file, returning it unchanged if it is not encrypted.
+func decryptConfig(data []byte, key string) ([]byte, bool, error) {
+	config := encryptedConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, false, err
+	}
+
+	if config.Encrypted.Algorithm == "" {
+		return data, false, nil
+	}
+
+	if config.Encrypted.Algorithm != configAlgorithm {
+		return nil, true, fmt.Errorf("Unsupported config encryption: %s", config.Encrypted.Algorithm)
+	}
+
+	if key == "" {
+		return nil, true, fmt.Errorf("Config is encrypted, set MATRIX_CONFIG_KEY or MATRIX_CONFIG_KEY_FILE")
+	}
+
+	decoded := map[string][]byte{}
+	for name, value := range map[string]string{
+		"salt":       config.Encrypted.Salt,
+		"nonce":      config.Encrypted.Nonce,
+		"ciphertext": config.Encrypted.Ciphertext,
+	} {
+		bytes, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, true, fmt.Errorf("Could not decode config %s: %s", name, err)
+		}
+		decoded[name] = bytes
+	}
+
+	aead, err := configCipher(key, decoded["salt"], config.Encrypted.Rounds)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if len(decoded["nonce"]) != aead.NonceSize() {
+		return nil, true, fmt.Errorf("Invalid config nonce")
+	}
+
+	plaintext, err := aead.Open(nil, decoded["nonce"], decoded["ciphertext"], nil)
+	if err != nil {
+		return nil, true, fmt.Errorf("Wrong config key or corrupted config")
+	}
+
+	return plaintext, true, nil
+}
+
+// A serialized bot. The Olm account is pickled with the config key if there is one,
+// rather than with the fixed key libolm-go uses.
+type botConfig struct {
+	Bot
+	Olm      *string `json:"olm"`
+	OlmKeyed bool    `json:"olmKeyed,omitempty"`
+}
+
+// Serialize a bot's credentials, encrypted with key unless it is empty.
+func encodeBot(b Bot, key string) ([]byte, error) {
+	config := botConfig{Bot: b, OlmKeyed: key != ""}
+
+	if b.Olm != nil {
+		pickleKey := key
+		if pickleKey == "" {
+			pickleKey = defaultPickleKey
+		}
+
+		pickle, err := pickleAccount(b.Olm, pickleKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Olm = &pickle
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		if data, err = encryptConfig(data, key); err != nil {
+			return nil, fmt.Errorf("Could not encrypt config: %s", err)
+		}
+	}
+
+	return data, nil
+}
+
+// Load a bot serialized by encodeBot. key is only needed if the config is encrypted,
+// it is also used to encrypt the bot's crypto state.
+func decodeBot(data []byte, key string) (Bot, error) {
+	b := Bot{}
+
+	data, _, err := decryptConfig(data, key)
+	if err != nil {
+		return b, err
+	}
+
+	config := botConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return b, err
+	}
+	b = config.Bot
+
+	if config.Olm != nil {
+		pickleKey := defaultPickleKey
+		if config.OlmKeyed {
+			pickleKey = key
+		}
+
+		if b.Olm, err = unpickleAccount(*config.Olm, pickleKey); err != nil {
+			return b, err
+		}
+	}
+
+	// The crypto state may have been saved with the key while the config was encrypted,
+	// so it is used whenever it is given, even once the config has been decrypted.
+	b.pickleKey = key
+
+	return b, b.Init()
+}
+
+// Write the bot's credentials to path, encrypted with key unless it is empty.
+func SerializeWithKey(b Bot, path, key string) error {
+	data, err := encodeBot(b, key)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// Load a bot written by SerializeWithKey. key is only needed if the config is
+// encrypted, it is also used to encrypt the bot's crypto state.
+func UnserializeWithKey(path, key string) (Bot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Bot{}, err
+	}
+
+	return decodeBot(data, key)
+}
@@ -0,0 +1,67 @@
+package matrix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	bot.UserId = "@bot:example.org"
+	bot.AccessToken = "secret-token"
+
+	assert.Nil(t, SerializeWithKey(bot, path, "config key"))
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(data), "secret-token"))
+
+	// The Olm account inside is pickled with the key as well.
+	plaintext, encrypted, err := decryptConfig(data, "config key")
+	assert.Nil(t, err)
+	assert.True(t, encrypted)
+	assert.True(t, strings.Contains(string(plaintext), `"olmKeyed":true`))
+
+	_, err = UnserializeWithKey(path, "")
+	assert.NotNil(t, err)
+	_, err = UnserializeWithKey(path, "wrong key")
+	assert.NotNil(t, err)
+
+	restored, err := UnserializeWithKey(path, "config key")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-token", restored.AccessToken)
+	assert.Equal(t, "config key", restored.olmPickleKey())
+
+	// Key files and unencrypted configs keep working.
+	keyFile := filepath.Join(dir, "key")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("config key\n"), 0600))
+	os.Setenv("MATRIX_CONFIG_KEY_FILE", keyFile)
+	defer os.Unsetenv("MATRIX_CONFIG_KEY_FILE")
+
+	restored, err = Unserialize(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-token", restored.AccessToken)
+
+	assert.Nil(t, SerializeWithKey(bot, path, ""))
+	restored, err = Unserialize(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-token", restored.AccessToken)
+	// The crypto state saved with the key must stay readable after decrypting the config.
+	assert.Equal(t, "config key", restored.olmPickleKey())
+
+	restored, err = UnserializeWithKey(path, "")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultPickleKey, restored.olmPickleKey())
+}
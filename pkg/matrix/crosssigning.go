@@ -0,0 +1,226 @@
+package matrix
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// The bot's cross-signing keys. The master key identifies the user, the self-signing
+// key signs the user's own devices and the user-signing key signs other users' master
+// keys.
+type CrossSigningKeys struct {
+	Master      ed25519.PrivateKey `json:"master"`
+	SelfSigning ed25519.PrivateKey `json:"selfSigning"`
+	UserSigning ed25519.PrivateKey `json:"userSigning"`
+	// True until the public keys have been uploaded.
+	Pending bool `json:"pending,omitempty"`
+}
+
+func generateCrossSigningKeys() (*CrossSigningKeys, error) {
+	keys := []ed25519.PrivateKey{}
+
+	for i := 0; i < 3; i++ {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Could not generate cross-signing key: %s", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return &CrossSigningKeys{
+		Master:      keys[0],
+		SelfSigning: keys[1],
+		UserSigning: keys[2],
+	}, nil
+}
+
+func encodePublicKey(key ed25519.PrivateKey) string {
+	return base64.RawStdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Sign a JSON object with key and add the signature to its signatures property.
+func signJSON(object map[string]interface{}, userId, keyId string, key ed25519.PrivateKey) error {
+	signed := map[string]interface{}{}
+	for k, v := range object {
+		if k != "signatures" && k != "unsigned" {
+			signed[k] = v
+		}
+	}
+
+	message, err := canonicalJSON(signed)
+	if err != nil {
+		return fmt.Errorf("Could not encode signed object: %s", err)
+	}
+
+	signatures, _ := object["signatures"].(map[string]map[string]string)
+	if signatures == nil {
+		signatures = map[string]map[string]string{}
+	}
+
+	if signatures[userId] == nil {
+		signatures[userId] = map[string]string{}
+	}
+
+	signatures[userId][keyId] = base64.RawStdEncoding.EncodeToString(ed25519.Sign(key, message))
+	object["signatures"] = signatures
+	return nil
+}
+
+// Build a cross-signing key object, signed by the master key unless it is the master
+// key itself.
+func (b *Bot) crossSigningKey(usage string, key, master ed25519.PrivateKey) (map[string]interface{}, error) {
+	keyId := "ed25519:" + encodePublicKey(key)
+
+	object := map[string]interface{}{
+		"user_id": b.UserId,
+		"usage":   []string{usage},
+		"keys":    map[string]string{keyId: encodePublicKey(key)},
+	}
+
+	if master != nil {
+		if err := signJSON(object, b.UserId, "ed25519:"+encodePublicKey(master), master); err != nil {
+			return nil, err
+		}
+	}
+
+	return object, nil
+}
+
+// Upload a set of cross-signing keys. Servers usually require the account password to
+// replace existing keys.
+func (b *Bot) uploadCrossSigningKeys(c context.Context, keys *CrossSigningKeys, password string) error {
+	body := map[string]interface{}{}
+
+	for name, key := range map[string]struct {
+		usage  string
+		key    ed25519.PrivateKey
+		master ed25519.PrivateKey
+	}{
+		"master_key":       {"master", keys.Master, nil},
+		"self_signing_key": {"self_signing", keys.SelfSigning, keys.Master},
+		"user_signing_key": {"user_signing", keys.UserSigning, keys.Master},
+	} {
+		object, err := b.crossSigningKey(key.usage, key.key, key.master)
+		if err != nil {
+			return err
+		}
+		body[name] = object
+	}
+
+	// The server may want us to authenticate with the password.
+	stages := AuthStages{}
+	if password != "" {
+		stages[AuthPassword] = PasswordAuth(b.UserId, password)
+	}
+
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			body["auth"] = auth
+		}
+		return b.doJSON(c, "POST", "/keys/device_signing/upload", body, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not upload cross-signing keys: %w", err)
+	}
+
+	return nil
+}
+
+// Sign our own device with the self-signing key so that other users who trust our
+// master key also trust this device.
+func (b *Bot) signOwnDevice(c context.Context) error {
+	if _, err := b.QueryDevices(c, b.UserId); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	device, ok := b.devices[b.UserId][b.DeviceId]
+	selfSigning := b.crossSigningKeys.SelfSigning
+	b.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Could not find the keys of device %s", b.DeviceId)
+	}
+
+	// Sign the keys exactly as the device published them, without its own signatures.
+	object, err := decodeSignedObject(device.SignedKeys)
+	if err != nil {
+		return fmt.Errorf("Could not decode the keys of device %s: %s", b.DeviceId, err)
+	}
+	delete(object, "signatures")
+	delete(object, "unsigned")
+
+	if err := signJSON(object, b.UserId, "ed25519:"+encodePublicKey(selfSigning), selfSigning); err != nil {
+		return err
+	}
+
+	err = b.doJSON(c, "POST", "/keys/signatures/upload", map[string]interface{}{
+		b.UserId: map[string]interface{}{
+			b.DeviceId: object,
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Could not upload device signature: %w", err)
+	}
+
+	return nil
+}
+
+// Generate cross-signing keys if we do not have any yet, upload them and sign this
+// device with them. password is used if the server requires authentication to upload
+// the keys. The private keys are kept in the crypto store.
+func (b *Bot) BootstrapCrossSigning(c context.Context, password string) error {
+	b.lock.Lock()
+	keys := b.crossSigningKeys
+	b.lock.Unlock()
+
+	// Save the keys before uploading them so that keys the server has accepted are never
+	// lost. If the upload fails the same keys are uploaded on the next attempt.
+	if keys == nil {
+		var err error
+		if keys, err = generateCrossSigningKeys(); err != nil {
+			return err
+		}
+		keys.Pending = true
+
+		b.lock.Lock()
+		b.crossSigningKeys = keys
+		b.lock.Unlock()
+
+		if err := b.saveCryptoState(); err != nil {
+			return err
+		}
+	}
+
+	if keys.Pending {
+		if err := b.uploadCrossSigningKeys(c, keys, password); err != nil {
+			return err
+		}
+
+		b.lock.Lock()
+		keys.Pending = false
+		b.lock.Unlock()
+
+		if err := b.saveCryptoState(); err != nil {
+			return err
+		}
+	}
+
+	return b.signOwnDevice(c)
+}
+
+// The public part of our master key, or an empty string if cross-signing has not been
+// set up.
+func (b *Bot) MasterKey() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.crossSigningKeys == nil || b.crossSigningKeys.Pending {
+		return ""
+	}
+
+	return encodePublicKey(b.crossSigningKeys.Master)
+}
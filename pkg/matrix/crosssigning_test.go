@@ -0,0 +1,99 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootstrapCrossSigning(t *testing.T) {
+	type crossSigningKey struct {
+		Keys       map[string]string            `json:"keys"`
+		Usage      []string                     `json:"usage"`
+		UserId     string                       `json:"user_id"`
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+
+	deviceKey := newSigningKey(t)
+	uploads := 0
+	var selfSigningKey crossSigningKey
+	var deviceSignatures map[string]map[string]map[string]interface{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/keys/device_signing/upload":
+			uploads++
+
+			body := struct {
+				MasterKey      crossSigningKey        `json:"master_key"`
+				SelfSigningKey crossSigningKey        `json:"self_signing_key"`
+				Auth           map[string]interface{} `json:"auth"`
+			}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+
+			if body.Auth == nil {
+				w.WriteHeader(401)
+				w.Write([]byte(`{"session": "abc", "flows": [{"stages": ["m.login.password"]}]}`))
+				return
+			}
+
+			assert.Equal(t, "abc", body.Auth["session"])
+			assert.Equal(t, "hunter2", body.Auth["password"])
+			assert.Equal(t, []string{"master"}, body.MasterKey.Usage)
+
+			for masterKeyId, masterKey := range body.MasterKey.Keys {
+				assert.Nil(t, verifySignature(map[string]interface{}{
+					"keys":    body.SelfSigningKey.Keys,
+					"usage":   body.SelfSigningKey.Usage,
+					"user_id": body.SelfSigningKey.UserId,
+				}, body.SelfSigningKey.Signatures, "@bot:example.org", masterKeyId, masterKey))
+			}
+
+			selfSigningKey = body.SelfSigningKey
+			w.Write([]byte("{}"))
+		case "/_matrix/client/unstable/keys/query":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_keys": map[string]interface{}{
+					"@bot:example.org": map[string]interface{}{
+						"BOTDEVICE": signedDeviceKeys(t, "@bot:example.org", "BOTDEVICE", deviceKey),
+					},
+				},
+			})
+		case "/_matrix/client/unstable/keys/signatures/upload":
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&deviceSignatures))
+			w.Write([]byte(`{"failures": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	// Keys that could not be uploaded are kept and uploaded on the next attempt.
+	assert.NotNil(t, bot.BootstrapCrossSigning(context.TODO(), ""))
+	assert.Equal(t, 1, uploads)
+	assert.Equal(t, "", bot.MasterKey())
+	masterKey := encodePublicKey(bot.crossSigningKeys.Master)
+
+	assert.Nil(t, bot.BootstrapCrossSigning(context.TODO(), "hunter2"))
+	assert.Equal(t, 3, uploads)
+	assert.Equal(t, masterKey, bot.MasterKey())
+
+	signed := deviceSignatures["@bot:example.org"]["BOTDEVICE"]
+	signatures := map[string]map[string]string{}
+	encoded, _ := json.Marshal(signed["signatures"])
+	assert.Nil(t, json.Unmarshal(encoded, &signatures))
+
+	for keyId, key := range selfSigningKey.Keys {
+		assert.Nil(t, verifySignature(signed, signatures, "@bot:example.org", keyId, key))
+	}
+
+	// Keys are only uploaded once, later bootstraps only sign the device again.
+	assert.Nil(t, bot.BootstrapCrossSigning(context.TODO(), ""))
+	assert.Equal(t, 3, uploads)
+}
@@ -0,0 +1,386 @@
+package matrix
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	libolm "github.com/justinbarrick/libolm-go"
+)
+
+const (
+	olmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	megolmAlgorithm = "m.megolm.v1.aes-sha2"
+
+	preKeyIdentityKeyTag = 0x1A
+
+	// How many message indexes of each inbound group session are remembered to detect
+	// replays, sessions are usually rotated long before.
+	maxMessageIndexes = 1000
+)
+
+// Details about how an event that was dispatched in plaintext was encrypted.
+type EncryptionInfo struct {
+	Algorithm string
+	// The curve25519 identity key of the sending device.
+	SenderKey string
+	// The ed25519 key the sending device claims to own. It is only trustworthy once
+	// the device's keys have been verified.
+	ClaimedEd25519Key string
+	SessionId         string
+}
+
+// The payload of an Olm encrypted to-device event.
+type olmPayload struct {
+	Type          string                 `json:"type"`
+	Content       map[string]interface{} `json:"content"`
+	Sender        string                 `json:"sender"`
+	Recipient     string                 `json:"recipient"`
+	RecipientKeys struct {
+		Ed25519 string `json:"ed25519"`
+	} `json:"recipient_keys"`
+	Keys struct {
+		Ed25519 string `json:"ed25519"`
+	} `json:"keys"`
+}
+
+// The payload of a Megolm encrypted room event.
+type megolmPayload struct {
+	Type    string                 `json:"type"`
+	Content map[string]interface{} `json:"content"`
+	RoomId  string                 `json:"room_id"`
+}
+
+func contentString(content map[string]interface{}, key string) string {
+	value, _ := content[key].(string)
+	return value
+}
+
+// Numbers are float64 in events decoded by encoding/json and json.Number in responses
+// decoded by the generated client.
+func contentNumber(content map[string]interface{}, key string) (float64, bool) {
+	switch value := content[key].(type) {
+	case float64:
+		return value, true
+	case json.Number:
+		number, err := value.Float64()
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func groupSessionKey(roomId, senderKey, sessionId string) string {
+	return fmt.Sprintf("%s|%s|%s", roomId, senderKey, sessionId)
+}
+
+// libolm-go panics instead of returning an error when a message cannot be decrypted
+// with a session, so recover and turn it into an error.
+func olmSessionDecrypt(session libolm.Session, messageType int, body string) (plaintext string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Could not decrypt message: %v", r)
+		}
+	}()
+
+	return session.Decrypt(messageType, body), nil
+}
+
+// Get the identity key of the sender of an Olm pre-key message. Pre-key messages are a
+// version byte followed by protobuf style fields, the identity key is field 3.
+func preKeyIdentityKey(body string) (string, error) {
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(body, "="))
+	if err != nil || len(data) == 0 {
+		return "", fmt.Errorf("Invalid pre-key message")
+	}
+
+	for i := 1; i < len(data); {
+		tag := data[i]
+		i++
+
+		length, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return "", fmt.Errorf("Invalid pre-key message")
+		}
+		i += n
+
+		// Only the length-delimited fields are used in pre-key messages.
+		if tag&7 != 2 {
+			continue
+		}
+
+		if length > uint64(len(data)-i) {
+			return "", fmt.Errorf("Invalid pre-key message")
+		}
+
+		if tag == preKeyIdentityKeyTag {
+			return base64.RawStdEncoding.EncodeToString(data[i : i+int(length)]), nil
+		}
+		i += int(length)
+	}
+
+	return "", fmt.Errorf("Pre-key message has no identity key")
+}
+
+// Decrypt an Olm message with an existing session for the sender, or create a new
+// inbound session if it is a pre-key message. b.lock must be held.
+func (b *Bot) olmDecrypt(senderKey string, messageType int, body string) (string, error) {
+	for _, session := range b.olmSessions[senderKey] {
+		if plaintext, err := olmSessionDecrypt(session, messageType, body); err == nil {
+			return plaintext, nil
+		}
+	}
+
+	if messageType != libolm.MESSAGE_TYPE_PRE_KEY {
+		return "", fmt.Errorf("No Olm session found for sender key %s", senderKey)
+	}
+
+	// The sender_key of the event is not authenticated, but the session can only be
+	// created by the owner of the identity key in the pre-key message. libolm-go's
+	// CreateInboundSessionFrom does not pass the identity key on to libolm, so it is
+	// compared here.
+	identityKey, err := preKeyIdentityKey(body)
+	if err != nil {
+		return "", err
+	}
+
+	if identityKey != senderKey {
+		return "", fmt.Errorf("Pre-key message identity key %s does not match sender key %s", identityKey, senderKey)
+	}
+
+	session := libolm.CreateInboundSessionFrom(b.Olm.GetAccount(), senderKey, body)
+
+	plaintext, err := olmSessionDecrypt(session, messageType, body)
+	if err != nil {
+		return "", err
+	}
+
+	if err := removeOneTimeKeys(b.Olm, session); err != nil {
+		return "", err
+	}
+	b.accountChanged = true
+
+	b.olmSessions[senderKey] = append(b.olmSessions[senderKey], session)
+	return plaintext, nil
+}
+
+func (b *Bot) decryptOlmEvent(event *Event) error {
+	senderKey := contentString(event.Content, "sender_key")
+	ourKey := b.Olm.GetIdentityKeys().Curve25519
+
+	ciphertexts, _ := event.Content["ciphertext"].(map[string]interface{})
+	ciphertext, ok := ciphertexts[ourKey].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Event was not encrypted for this device")
+	}
+
+	messageType, _ := ciphertext["type"].(float64)
+	body := contentString(ciphertext, "body")
+
+	plaintext, err := b.olmDecrypt(senderKey, int(messageType), body)
+	if err != nil {
+		return err
+	}
+
+	payload := olmPayload{}
+	if err := json.Unmarshal([]byte(plaintext), &payload); err != nil {
+		return fmt.Errorf("Could not decode decrypted event: %s", err)
+	}
+
+	if payload.Sender != event.Sender {
+		return fmt.Errorf("Decrypted event sender %s does not match %s", payload.Sender, event.Sender)
+	}
+
+	if payload.Recipient != b.UserId || payload.RecipientKeys.Ed25519 != b.Olm.GetIdentityKeys().Ed25519 {
+		return fmt.Errorf("Decrypted event was not intended for this device")
+	}
+
+	event.Type = payload.Type
+	event.Content = payload.Content
+	event.Encryption = &EncryptionInfo{
+		Algorithm:         olmAlgorithm,
+		SenderKey:         senderKey,
+		ClaimedEd25519Key: payload.Keys.Ed25519,
+	}
+
+	return nil
+}
+
+// Remember the event that used a message index of an inbound group session, so that
+// the index cannot be replayed in another event. Only the latest maxMessageIndexes
+// indexes of each session are kept, older ones are forgotten. b.lock must be held.
+func (b *Bot) recordMessageIndex(key string, index uint32, eventId string) {
+	indexes := b.messageIndexes[key]
+	if indexes == nil {
+		indexes = map[uint32]string{}
+		b.messageIndexes[key] = indexes
+	}
+
+	if _, ok := indexes[index]; ok {
+		return
+	}
+
+	indexes[index] = eventId
+	b.messageIndexesChanged = true
+
+	if len(indexes) <= maxMessageIndexes {
+		return
+	}
+
+	lowest := index
+	for i := range indexes {
+		if i < lowest {
+			lowest = i
+		}
+	}
+	delete(indexes, lowest)
+}
+
+func (b *Bot) decryptMegolmEvent(event *Event) error {
+	senderKey := contentString(event.Content, "sender_key")
+	sessionId := contentString(event.Content, "session_id")
+	key := groupSessionKey(event.RoomId, senderKey, sessionId)
+
+	session, ok := b.inboundGroupSessions[key]
+	if !ok {
+		return fmt.Errorf("Unknown Megolm session %s", sessionId)
+	}
+
+	plaintext, index, err := session.Decrypt(contentString(event.Content, "ciphertext"))
+	if err != nil {
+		return err
+	}
+
+	if eventId, ok := b.messageIndexes[key][index]; ok && eventId != event.EventId {
+		return fmt.Errorf("Message index %d of session %s was replayed", index, sessionId)
+	}
+	b.recordMessageIndex(key, index, event.EventId)
+
+	payload := megolmPayload{}
+	if err := json.Unmarshal([]byte(plaintext), &payload); err != nil {
+		return fmt.Errorf("Could not decode decrypted event: %s", err)
+	}
+
+	if payload.RoomId != event.RoomId {
+		return fmt.Errorf("Decrypted event room %s does not match %s", payload.RoomId, event.RoomId)
+	}
+
+	event.Type = payload.Type
+	event.Content = payload.Content
+	event.Encryption = &EncryptionInfo{
+		Algorithm: megolmAlgorithm,
+		SenderKey: senderKey,
+		SessionId: sessionId,
+	}
+
+	return nil
+}
+
+// Decrypt an m.room.encrypted event in place. Events of any other type are left
+// untouched.
+func (b *Bot) DecryptEvent(c context.Context, event *Event) error {
+	if event.Type != "m.room.encrypted" {
+		return nil
+	}
+
+	b.lock.Lock()
+	err := b.decryptEvent(event)
+	accountChanged := b.accountChanged
+	b.accountChanged = false
+	b.lock.Unlock()
+
+	// The account lost a one-time key, save it so it is not used again after a restart.
+	if accountChanged {
+		if err := b.saveConfig(); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// b.lock must be held.
+func (b *Bot) decryptEvent(event *Event) error {
+	switch algorithm := contentString(event.Content, "algorithm"); algorithm {
+	case olmAlgorithm:
+		if b.Olm == nil {
+			return fmt.Errorf("No Olm account, cannot decrypt events")
+		}
+		return b.decryptOlmEvent(event)
+	case megolmAlgorithm:
+		return b.decryptMegolmEvent(event)
+	default:
+		return fmt.Errorf("Unsupported encryption algorithm: %s", algorithm)
+	}
+}
+
+// Store the inbound Megolm session from a decrypted m.room_key event. The key is only
+// accepted from a known device of the sender that owns both the curve25519 key the
+// Olm session was created with and the ed25519 key claimed in the event.
+func (b *Bot) handleRoomKey(c context.Context, event *Event) error {
+	if event.Encryption == nil || event.Encryption.Algorithm != olmAlgorithm {
+		return fmt.Errorf("Ignoring room key that was not received over Olm")
+	}
+
+	if _, err := b.queryDeviceKeys(c, []string{event.Sender}); err != nil {
+		return err
+	}
+
+	if device := b.deviceBySenderKey(event.Sender, event.Encryption.SenderKey); device == nil || device.Ed25519Key != event.Encryption.ClaimedEd25519Key {
+		return fmt.Errorf("Ignoring room key from unknown device of %s", event.Sender)
+	}
+
+	if contentString(event.Content, "algorithm") != megolmAlgorithm {
+		return fmt.Errorf("Unsupported room key algorithm: %s", contentString(event.Content, "algorithm"))
+	}
+
+	session, err := megolm.NewInboundSession(contentString(event.Content, "session_key"))
+	if err != nil {
+		return err
+	}
+
+	if session.GetSessionID() != contentString(event.Content, "session_id") {
+		return fmt.Errorf("Room key session ID does not match its session key")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.addInboundGroupSession(contentString(event.Content, "room_id"), event.Encryption.SenderKey, event.Encryption.ClaimedEd25519Key, session)
+	return nil
+}
+
+// Add an inbound group session unless we already have one that can decrypt
+// earlier messages. claimedKey is the ed25519 key of the device that sent it, if
+// known. b.lock must be held.
+func (b *Bot) addInboundGroupSession(roomId, senderKey, claimedKey string, session *megolm.InboundSession) {
+	key := groupSessionKey(roomId, senderKey, session.GetSessionID())
+
+	if existing, ok := b.inboundGroupSessions[key]; ok && existing.FirstKnownIndex() <= session.FirstKnownIndex() {
+		return
+	}
+
+	b.inboundGroupSessions[key] = session
+	delete(b.backedUpSessions, key)
+
+	// The sender key is part of the session's key, so a session from the same device
+	// without a claimed key keeps the one we know.
+	if claimedKey != "" {
+		b.senderClaimedKeys[key] = claimedKey
+	}
+}
+
+// Decrypt an event received over sync before it is dispatched. Events that cannot be
+// decrypted are dispatched as m.room.encrypted, handlers can call DecryptEvent to find
+// out why. Room keys that cannot be stored are reported to the sync error handler.
+func (b *Bot) decryptSyncEvent(c context.Context, event *Event) {
+	if err := b.DecryptEvent(c, event); err == nil && event.Type == "m.room_key" {
+		if err := b.handleRoomKey(c, event); err != nil {
+			b.syncError(err)
+		}
+	}
+}
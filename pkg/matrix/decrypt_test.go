@@ -0,0 +1,200 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptedTimeline(t *testing.T, session *megolm.OutboundSession, roomId string, events ...string) string {
+	timeline := []map[string]interface{}{}
+
+	for i, body := range events {
+		plaintext, err := json.Marshal(map[string]interface{}{
+			"type":    "m.room.message",
+			"room_id": roomId,
+			"content": map[string]string{"msgtype": "m.text", "body": body},
+		})
+		assert.Nil(t, err)
+
+		_, ciphertext := session.Encrypt(string(plaintext))
+
+		timeline = append(timeline, map[string]interface{}{
+			"type":     "m.room.encrypted",
+			"event_id": fmt.Sprintf("$%d", i),
+			"sender":   "@alice:example.org",
+			"content": map[string]string{
+				"algorithm":  megolmAlgorithm,
+				"sender_key": "alicekey",
+				"session_id": session.GetSessionID(),
+				"device_id":  "ALICE",
+				"ciphertext": ciphertext,
+			},
+		})
+	}
+
+	response, err := json.Marshal(map[string]interface{}{
+		"next_batch": "s1",
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{
+				roomId: map[string]interface{}{
+					"timeline": map[string]interface{}{"events": timeline},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	return string(response)
+}
+
+func TestSyncDecryptsMegolmEvents(t *testing.T) {
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	response := encryptedTimeline(t, outbound, "!room:example.org", "hello", "world")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.addInboundGroupSession("!room:example.org", "alicekey", "", inbound)
+
+	messages := []*Event{}
+	bot.On("m.room.message", func(c context.Context, event *Event) {
+		messages = append(messages, event)
+	})
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "hello", messages[0].Content["body"])
+	assert.Equal(t, "world", messages[1].Content["body"])
+	assert.Equal(t, "$1", messages[1].EventId)
+	assert.Equal(t, "alicekey", messages[1].Encryption.SenderKey)
+	assert.Equal(t, outbound.GetSessionID(), messages[1].Encryption.SessionId)
+}
+
+func TestDecryptEventRejectsReplays(t *testing.T) {
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	bot.addInboundGroupSession("!room:example.org", "alicekey", "", inbound)
+
+	response := syncResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(encryptedTimeline(t, outbound, "!room:example.org", "hello")), &response))
+
+	event := response.Rooms.Join["!room:example.org"].Timeline.Events[0]
+	event.RoomId = "!room:example.org"
+	original := *event
+
+	assert.Nil(t, bot.DecryptEvent(context.TODO(), event))
+	assert.Equal(t, "m.room.message", event.Type)
+
+	replayed := original
+	assert.Nil(t, bot.DecryptEvent(context.TODO(), &replayed))
+
+	replayed = original
+	replayed.EventId = "$other"
+	assert.NotNil(t, bot.DecryptEvent(context.TODO(), &replayed))
+	assert.Equal(t, "m.room.encrypted", replayed.Type)
+
+	wrongRoom := original
+	wrongRoom.RoomId = "!other:example.org"
+	assert.NotNil(t, bot.DecryptEvent(context.TODO(), &wrongRoom))
+}
+
+func TestPreKeyIdentityKey(t *testing.T) {
+	key := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 32)
+	}
+
+	message := []byte{3}
+	message = append(append(message, 0x0A, 32), key(1)...)
+	message = append(append(message, 0x12, 32), key(2)...)
+	message = append(append(message, 0x1A, 32), key(3)...)
+	message = append(append(message, 0x22, 4), "olm!"...)
+
+	identityKey, err := preKeyIdentityKey(base64.RawStdEncoding.EncodeToString(message))
+	assert.Nil(t, err)
+	assert.Equal(t, base64.RawStdEncoding.EncodeToString(key(3)), identityKey)
+
+	_, err = preKeyIdentityKey(base64.RawStdEncoding.EncodeToString(message[:70]))
+	assert.NotNil(t, err)
+
+	_, err = preKeyIdentityKey("not base64!")
+	assert.NotNil(t, err)
+}
+
+func TestHandleRoomKeyChecksSendingDevice(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	bot.deviceListsSynced = true
+	bot.deviceKeyCache["@alice:example.org"] = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+	bot.devices["@alice:example.org"] = map[string]*Device{
+		"ALICE": {UserId: "@alice:example.org", DeviceId: "ALICE", Curve25519Key: "alicecurve", Ed25519Key: "aliceed"},
+	}
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+
+	roomKey := func(senderKey, ed25519Key string) *Event {
+		return &Event{
+			Type:   "m.room_key",
+			Sender: "@alice:example.org",
+			Content: map[string]interface{}{
+				"algorithm":   megolmAlgorithm,
+				"room_id":     "!room:example.org",
+				"session_id":  outbound.GetSessionID(),
+				"session_key": outbound.GetSessionKey(),
+			},
+			Encryption: &EncryptionInfo{
+				Algorithm:         olmAlgorithm,
+				SenderKey:         senderKey,
+				ClaimedEd25519Key: ed25519Key,
+			},
+		}
+	}
+
+	key := groupSessionKey("!room:example.org", "alicecurve", outbound.GetSessionID())
+
+	// A device cannot pass off room keys as another device's.
+	assert.NotNil(t, bot.handleRoomKey(context.TODO(), roomKey("alicecurve", "malloryed")))
+	assert.NotNil(t, bot.handleRoomKey(context.TODO(), roomKey("mallorycurve", "aliceed")))
+	assert.Nil(t, bot.inboundGroupSessions[key])
+
+	assert.Nil(t, bot.handleRoomKey(context.TODO(), roomKey("alicecurve", "aliceed")))
+	assert.NotNil(t, bot.inboundGroupSessions[key])
+	assert.Equal(t, "aliceed", bot.senderClaimedKeys[key])
+}
+
+func TestMessageIndexesAreBounded(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	for i := uint32(0); i < maxMessageIndexes+10; i++ {
+		bot.recordMessageIndex("session", i, fmt.Sprintf("$%d", i))
+	}
+
+	assert.Equal(t, maxMessageIndexes, len(bot.messageIndexes["session"]))
+	assert.Equal(t, "", bot.messageIndexes["session"][9])
+	assert.Equal(t, "$10", bot.messageIndexes["session"][10])
+	assert.True(t, bot.messageIndexesChanged)
+}
@@ -0,0 +1,112 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/end_to_end_encryption"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// Forget the cached device keys of users so that they are queried again before the
+// next room key is shared. b.lock must be held.
+func (b *Bot) invalidateDeviceLists(userIds []string) {
+	for _, userId := range userIds {
+		delete(b.deviceKeyCache, userId)
+	}
+}
+
+// Invalidate the cached device keys of every user whose devices changed between two
+// sync tokens.
+func (b *Bot) FetchKeyChanges(c context.Context, from, to string) error {
+	params := end_to_end_encryption.NewGetKeysChangesParamsWithContext(c)
+	params.SetFrom(from)
+	params.SetTo(to)
+
+	changes, err := b.client.EndToEndEncryption.GetKeysChanges(params, b)
+	if err != nil {
+		return fmt.Errorf("Could not fetch key changes: %w", err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.invalidateDeviceLists(changes.Payload.Changed)
+	b.invalidateDeviceLists(changes.Payload.Left)
+	return nil
+}
+
+// Bring the device key cache up to date with a sync response. The cache is only
+// trusted once we are syncing, as sync is how we learn about new devices.
+func (b *Bot) handleDeviceLists(c context.Context, since, nextBatch string, lists syncDeviceLists) {
+	b.lock.Lock()
+	deviceListToken := b.deviceListToken
+	b.lock.Unlock()
+
+	reset := since == "" || deviceListToken == ""
+	if !reset && deviceListToken != since {
+		// The cache was saved at a different point than the sync token, catch up on
+		// what changed in between.
+		reset = b.FetchKeyChanges(c, deviceListToken, since) != nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if reset {
+		// An initial sync does not report device list changes, so start over when we
+		// cannot tell what changed.
+		b.deviceKeyCache = map[string]models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+	}
+
+	b.invalidateDeviceLists(lists.Changed)
+	b.invalidateDeviceLists(lists.Left)
+
+	b.deviceListToken = nextBatch
+	b.deviceListsSynced = true
+}
+
+// Get the keys of the devices of the given users with a valid self-signature, only
+// querying the server for users whose device lists are not cached or may be outdated.
+func (b *Bot) queryDeviceKeys(c context.Context, userIds []string) (models.QueryKeysOKBodyDeviceKeys, error) {
+	deviceKeys := models.QueryKeysOKBodyDeviceKeys{}
+	wantedDeviceKeys := map[string][]string{}
+
+	b.lock.Lock()
+	for _, userId := range userIds {
+		if devices, ok := b.deviceKeyCache[userId]; ok && b.deviceListsSynced {
+			deviceKeys[userId] = devices
+		} else {
+			wantedDeviceKeys[userId] = []string{}
+		}
+	}
+	b.lock.Unlock()
+
+	if len(wantedDeviceKeys) == 0 {
+		return deviceKeys, nil
+	}
+
+	queried, err := b.queryKeys(c, wantedDeviceKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	valid := b.updateDevices(queried)
+
+	for userId := range wantedDeviceKeys {
+		devices := valid[userId]
+		if devices == nil {
+			devices = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+		}
+
+		deviceKeys[userId] = devices
+		if b.deviceListsSynced {
+			b.deviceKeyCache[userId] = devices
+		}
+	}
+
+	return deviceKeys, nil
+}
@@ -0,0 +1,97 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceListsInvalidatedBySync(t *testing.T) {
+	aliceDevices := models.QueryKeysOKBodyDeviceKeysAdditionalProperties{
+		"PHONE": signedDeviceKeys(t, "@alice:example.org", "PHONE", newSigningKey(t)),
+	}
+	changed := []string{}
+	queries := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/sync":
+			lists, _ := json.Marshal(changed)
+			fmt.Fprintf(w, `{"next_batch": "s%d", "device_lists": {"changed": %s}}`, queries, lists)
+		case "/_matrix/client/unstable/keys/query":
+			queries++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_keys": map[string]interface{}{"@alice:example.org": aliceDevices},
+			})
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	// Device lists are not cached until we are syncing.
+	_, err := bot.queryDeviceKeys(context.TODO(), []string{"@alice:example.org"})
+	assert.Nil(t, err)
+	_, err = bot.queryDeviceKeys(context.TODO(), []string{"@alice:example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queries)
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	_, err = bot.queryDeviceKeys(context.TODO(), []string{"@alice:example.org"})
+	assert.Nil(t, err)
+	deviceKeys, err := bot.queryDeviceKeys(context.TODO(), []string{"@alice:example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, queries)
+	assert.Equal(t, 1, len(deviceKeys["@alice:example.org"]))
+
+	aliceDevices["LAPTOP"] = signedDeviceKeys(t, "@alice:example.org", "LAPTOP", newSigningKey(t))
+	changed = []string{"@alice:example.org"}
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	deviceKeys, err = bot.queryDeviceKeys(context.TODO(), []string{"@alice:example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, queries)
+	assert.Equal(t, 2, len(deviceKeys["@alice:example.org"]))
+}
+
+func TestDeviceListsCatchUpWithKeyChanges(t *testing.T) {
+	from := ""
+	to := ""
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/sync":
+			fmt.Fprint(w, `{"next_batch": "s3"}`)
+		case "/_matrix/client/unstable/keys/changes":
+			from = r.URL.Query().Get("from")
+			to = r.URL.Query().Get("to")
+			fmt.Fprint(w, `{"changed": ["@alice:example.org"], "left": []}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.nextBatch = "s2"
+	bot.deviceListToken = "s1"
+	bot.deviceKeyCache["@alice:example.org"] = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+	bot.deviceKeyCache["@bob:example.org"] = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	assert.Equal(t, "s1", from)
+	assert.Equal(t, "s2", to)
+	assert.NotContains(t, bot.deviceKeyCache, "@alice:example.org")
+	assert.Contains(t, bot.deviceKeyCache, "@bob:example.org")
+	assert.Equal(t, "s3", bot.deviceListToken)
+}
@@ -0,0 +1,263 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// How much we trust a device with our room keys.
+type TrustState string
+
+const (
+	DeviceUnverified  TrustState = "unverified"
+	DeviceVerified    TrustState = "verified"
+	DeviceBlacklisted TrustState = "blacklisted"
+)
+
+// Which devices HandshakeRoom shares room keys with.
+type KeySharePolicy string
+
+const (
+	// Share room keys with every device that is not blacklisted, the default.
+	ShareWithUnblacklisted KeySharePolicy = "unblacklisted"
+	// Only share room keys with devices that have been verified.
+	ShareWithVerified KeySharePolicy = "verified"
+)
+
+// A device whose keys have been validated against its self-signature.
+type Device struct {
+	UserId        string     `json:"userId"`
+	DeviceId      string     `json:"deviceId"`
+	Ed25519Key    string     `json:"ed25519Key"`
+	Curve25519Key string     `json:"curve25519Key"`
+	Algorithms    []string   `json:"algorithms"`
+	Trust         TrustState `json:"trust"`
+	// The device keys as returned by /keys/query, which the device's signature covers.
+	SignedKeys json.RawMessage `json:"signedKeys,omitempty"`
+}
+
+// Device keys returned by /keys/query by user ID and device ID, kept as JSON because
+// the signatures cover fields that the generated models leave out.
+type rawDeviceKeys map[string]map[string]json.RawMessage
+
+// Query the keys of the given devices, by user ID. An empty list of devices queries
+// all of the user's devices.
+func (b *Bot) queryKeys(c context.Context, wantedDeviceKeys map[string][]string) (rawDeviceKeys, error) {
+	result := struct {
+		DeviceKeys rawDeviceKeys `json:"device_keys"`
+	}{}
+
+	err := b.doJSON(c, "POST", "/keys/query", map[string]interface{}{
+		"device_keys": wantedDeviceKeys,
+	}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching keys: %w", err)
+	}
+
+	return result.DeviceKeys, nil
+}
+
+// Validate the keys of a device returned by /keys/query.
+func deviceFromKeys(userId, deviceId string, signedKeys json.RawMessage) (*Device, models.QueryKeysOKBodyDeviceKeysAdditionalPropertiesAdditionalProperties, error) {
+	keys := models.QueryKeysOKBodyDeviceKeysAdditionalPropertiesAdditionalProperties{}
+	if err := json.Unmarshal(signedKeys, &keys); err != nil {
+		return nil, keys, fmt.Errorf("Could not decode device keys for %s %s: %s", userId, deviceId, err)
+	}
+
+	if keys.UserID == nil || *keys.UserID != userId || keys.DeviceID == nil || *keys.DeviceID != deviceId {
+		return nil, keys, fmt.Errorf("Device keys for %s %s have mismatched IDs", userId, deviceId)
+	}
+
+	keyId := fmt.Sprintf("ed25519:%s", deviceId)
+
+	device := &Device{
+		UserId:        userId,
+		DeviceId:      deviceId,
+		Ed25519Key:    keys.Keys[keyId],
+		Curve25519Key: keys.Keys[fmt.Sprintf("curve25519:%s", deviceId)],
+		Algorithms:    keys.Algorithms,
+		Trust:         DeviceUnverified,
+		SignedKeys:    signedKeys,
+	}
+
+	object, err := decodeSignedObject(signedKeys)
+	if err != nil {
+		return nil, keys, fmt.Errorf("Could not decode device keys for %s %s: %s", userId, deviceId, err)
+	}
+
+	if err := verifySignature(object, keys.Signatures, userId, keyId, device.Ed25519Key); err != nil {
+		return nil, keys, fmt.Errorf("Could not verify device %s %s: %s", userId, deviceId, err)
+	}
+
+	return device, keys, nil
+}
+
+// Set which devices room keys are shared with.
+func (b *Bot) SetKeySharePolicy(policy KeySharePolicy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.keySharePolicy = policy
+}
+
+// Add devices returned by /keys/query to the device store and return the ones that
+// have a valid self-signature. A device whose ed25519 key differs from the one we saw
+// first is rejected, as the server may be trying to impersonate it. b.lock must be held.
+func (b *Bot) updateDevices(deviceKeys rawDeviceKeys) models.QueryKeysOKBodyDeviceKeys {
+	valid := models.QueryKeysOKBodyDeviceKeys{}
+
+	for userId, devices := range deviceKeys {
+		for deviceId, signedKeys := range devices {
+			device, keys, err := deviceFromKeys(userId, deviceId, signedKeys)
+			if err != nil {
+				continue
+			}
+
+			if known, ok := b.devices[userId][deviceId]; ok {
+				if known.Ed25519Key != device.Ed25519Key {
+					continue
+				}
+				device.Trust = known.Trust
+			}
+
+			if b.devices[userId] == nil {
+				b.devices[userId] = map[string]*Device{}
+			}
+			b.devices[userId][deviceId] = device
+
+			if valid[userId] == nil {
+				valid[userId] = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+			}
+			valid[userId][deviceId] = keys
+		}
+	}
+
+	return valid
+}
+
+// Filter validated device keys down to the ones we may share room keys with under the
+// key share policy. b.lock must be held.
+func (b *Bot) trustedDeviceKeys(deviceKeys models.QueryKeysOKBodyDeviceKeys) models.QueryKeysOKBodyDeviceKeys {
+	trusted := models.QueryKeysOKBodyDeviceKeys{}
+
+	for userId, devices := range deviceKeys {
+		for deviceId, keys := range devices {
+			switch b.devices[userId][deviceId].Trust {
+			case DeviceBlacklisted:
+				continue
+			case DeviceUnverified:
+				if b.keySharePolicy == ShareWithVerified {
+					continue
+				}
+			}
+
+			if trusted[userId] == nil {
+				trusted[userId] = models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+			}
+			trusted[userId][deviceId] = keys
+		}
+	}
+
+	return trusted
+}
+
+// Fetch the devices of the given users from the server and add them to the device
+// store. Devices with invalid signatures are left out.
+func (b *Bot) QueryDevices(c context.Context, userIds ...string) ([]*Device, error) {
+	wantedDeviceKeys := map[string][]string{}
+	for _, userId := range userIds {
+		wantedDeviceKeys[userId] = []string{}
+	}
+
+	deviceKeys, err := b.queryKeys(c, wantedDeviceKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.updateDevices(deviceKeys)
+	b.lock.Unlock()
+
+	if err := b.saveCryptoState(); err != nil {
+		return nil, err
+	}
+
+	devices := []*Device{}
+	for _, userId := range userIds {
+		devices = append(devices, b.Devices(userId)...)
+	}
+
+	return devices, nil
+}
+
+// Get the devices of a user from the device store, sorted by device ID.
+func (b *Bot) Devices(userId string) []*Device {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	devices := []*Device{}
+
+	for _, device := range b.devices[userId] {
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+
+	return devices
+}
+
+// Set the trust state of a device in the device store. Use QueryDevices first if the
+// device has not been seen yet.
+func (b *Bot) SetDeviceTrust(userId, deviceId string, trust TrustState) error {
+	b.lock.Lock()
+	device, ok := b.devices[userId][deviceId]
+	if ok {
+		device.Trust = trust
+	}
+	b.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown device %s %s", userId, deviceId)
+	}
+
+	return b.saveCryptoState()
+}
+
+// Mark a device as verified, for example after comparing its ed25519 key out of band.
+func (b *Bot) VerifyDevice(userId, deviceId string) error {
+	return b.SetDeviceTrust(userId, deviceId, DeviceVerified)
+}
+
+// Mark a device as blacklisted so that it never receives our room keys.
+func (b *Bot) BlacklistDevice(userId, deviceId string) error {
+	return b.SetDeviceTrust(userId, deviceId, DeviceBlacklisted)
+}
+
+// Whether a device is in the device store.
+func (b *Bot) knownDevice(userId, deviceId string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.devices[userId][deviceId]
+	return ok
+}
+
+// Find a known device of a user by its curve25519 identity key.
+func (b *Bot) deviceBySenderKey(userId, senderKey string) *Device {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, device := range b.devices[userId] {
+		if device.Curve25519Key == senderKey {
+			return device
+		}
+	}
+
+	return nil
+}
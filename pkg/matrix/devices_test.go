@@ -0,0 +1,176 @@
+package matrix
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build the /keys/query device_keys for a device, self-signed with signingKey.
+func signedDeviceKeys(t *testing.T, userId, deviceId string, signingKey ed25519.PrivateKey) models.QueryKeysOKBodyDeviceKeysAdditionalPropertiesAdditionalProperties {
+	keyId := fmt.Sprintf("ed25519:%s", deviceId)
+
+	object := map[string]interface{}{
+		"algorithms": []string{olmAlgorithm, megolmAlgorithm},
+		"device_id":  deviceId,
+		"user_id":    userId,
+		"keys": map[string]string{
+			keyId:                                  base64.RawStdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+			fmt.Sprintf("curve25519:%s", deviceId): "curvekey",
+		},
+	}
+
+	message, err := canonicalJSON(object)
+	assert.Nil(t, err)
+
+	object["signatures"] = map[string]map[string]string{
+		userId: {keyId: base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, message))},
+	}
+
+	encoded, err := json.Marshal(object)
+	assert.Nil(t, err)
+
+	keys := models.QueryKeysOKBodyDeviceKeysAdditionalPropertiesAdditionalProperties{}
+	assert.Nil(t, json.Unmarshal(encoded, &keys))
+	return keys
+}
+
+// Encode device keys as they are returned by /keys/query.
+func encodeDeviceKeys(t *testing.T, deviceKeys models.QueryKeysOKBodyDeviceKeys) rawDeviceKeys {
+	raw := rawDeviceKeys{}
+	for userId, devices := range deviceKeys {
+		raw[userId] = map[string]json.RawMessage{}
+		for deviceId, keys := range devices {
+			encoded, err := json.Marshal(keys)
+			assert.Nil(t, err)
+			raw[userId][deviceId] = encoded
+		}
+	}
+	return raw
+}
+
+func newSigningKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return key
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	encoded, err := canonicalJSON(map[string]interface{}{
+		"b": "<&>",
+		"a": map[string]interface{}{"d": 1, "c": []int{2, 3}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":{"c":[2,3],"d":1},"b":"<&>"}`, string(encoded))
+}
+
+func TestUpdateDevicesChecksSignatures(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	forged := signedDeviceKeys(t, "@alice:example.org", "FORGED", newSigningKey(t))
+	forged.Keys["ed25519:FORGED"] = base64.RawStdEncoding.EncodeToString(newSigningKey(t).Public().(ed25519.PublicKey))
+
+	mismatched := signedDeviceKeys(t, "@alice:example.org", "OTHER", newSigningKey(t))
+
+	valid := bot.updateDevices(encodeDeviceKeys(t, models.QueryKeysOKBodyDeviceKeys{
+		"@alice:example.org": {
+			"ALICE":  signedDeviceKeys(t, "@alice:example.org", "ALICE", newSigningKey(t)),
+			"FORGED": forged,
+			"WRONG":  mismatched,
+		},
+	}))
+
+	assert.Equal(t, 1, len(valid["@alice:example.org"]))
+	assert.Contains(t, valid["@alice:example.org"], "ALICE")
+
+	devices := bot.Devices("@alice:example.org")
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, "ALICE", devices[0].DeviceId)
+	assert.Equal(t, "curvekey", devices[0].Curve25519Key)
+	assert.Equal(t, DeviceUnverified, devices[0].Trust)
+}
+
+func TestUpdateDevicesVerifiesUnknownFields(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	signingKey := newSigningKey(t)
+	object := map[string]interface{}{
+		"algorithms": []string{olmAlgorithm, megolmAlgorithm},
+		"device_id":  "ALICE",
+		"user_id":    "@alice:example.org",
+		"keys": map[string]string{
+			"ed25519:ALICE":    base64.RawStdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+			"curve25519:ALICE": "curvekey",
+		},
+		"org.example.extra": map[string]interface{}{"count": 1},
+	}
+
+	message, err := canonicalJSON(object)
+	assert.Nil(t, err)
+
+	object["signatures"] = map[string]map[string]string{
+		"@alice:example.org": {"ed25519:ALICE": base64.RawStdEncoding.EncodeToString(ed25519.Sign(signingKey, message))},
+	}
+	object["unsigned"] = map[string]string{"device_display_name": "Alice's phone"}
+
+	encoded, err := json.Marshal(object)
+	assert.Nil(t, err)
+
+	valid := bot.updateDevices(rawDeviceKeys{"@alice:example.org": {"ALICE": encoded}})
+	assert.Contains(t, valid["@alice:example.org"], "ALICE")
+	assert.Equal(t, json.RawMessage(encoded), bot.Devices("@alice:example.org")[0].SignedKeys)
+}
+
+func TestUpdateDevicesRejectsChangedKeys(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	original := signedDeviceKeys(t, "@alice:example.org", "ALICE", newSigningKey(t))
+	bot.updateDevices(encodeDeviceKeys(t, models.QueryKeysOKBodyDeviceKeys{"@alice:example.org": {"ALICE": original}}))
+	assert.Nil(t, bot.VerifyDevice("@alice:example.org", "ALICE"))
+
+	replaced := signedDeviceKeys(t, "@alice:example.org", "ALICE", newSigningKey(t))
+	valid := bot.updateDevices(encodeDeviceKeys(t, models.QueryKeysOKBodyDeviceKeys{"@alice:example.org": {"ALICE": replaced}}))
+	assert.Empty(t, valid)
+	assert.Equal(t, original.Keys["ed25519:ALICE"], bot.Devices("@alice:example.org")[0].Ed25519Key)
+
+	valid = bot.updateDevices(encodeDeviceKeys(t, models.QueryKeysOKBodyDeviceKeys{"@alice:example.org": {"ALICE": original}}))
+	assert.Contains(t, valid["@alice:example.org"], "ALICE")
+	assert.Equal(t, DeviceVerified, bot.Devices("@alice:example.org")[0].Trust)
+}
+
+func TestTrustedDeviceKeys(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	deviceKeys := models.QueryKeysOKBodyDeviceKeys{
+		"@alice:example.org": {
+			"VERIFIED":    signedDeviceKeys(t, "@alice:example.org", "VERIFIED", newSigningKey(t)),
+			"UNVERIFIED":  signedDeviceKeys(t, "@alice:example.org", "UNVERIFIED", newSigningKey(t)),
+			"BLACKLISTED": signedDeviceKeys(t, "@alice:example.org", "BLACKLISTED", newSigningKey(t)),
+		},
+	}
+
+	deviceKeys = bot.updateDevices(encodeDeviceKeys(t, deviceKeys))
+	assert.Nil(t, bot.VerifyDevice("@alice:example.org", "VERIFIED"))
+	assert.Nil(t, bot.BlacklistDevice("@alice:example.org", "BLACKLISTED"))
+	assert.NotNil(t, bot.VerifyDevice("@alice:example.org", "UNKNOWN"))
+
+	trusted := bot.trustedDeviceKeys(deviceKeys)["@alice:example.org"]
+	assert.Equal(t, 2, len(trusted))
+	assert.Contains(t, trusted, "VERIFIED")
+	assert.Contains(t, trusted, "UNVERIFIED")
+
+	bot.SetKeySharePolicy(ShareWithVerified)
+	trusted = bot.trustedDeviceKeys(deviceKeys)["@alice:example.org"]
+	assert.Equal(t, 1, len(trusted))
+	assert.Contains(t, trusted, "VERIFIED")
+}
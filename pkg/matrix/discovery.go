@@ -0,0 +1,133 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/justinbarrick/go-matrix/pkg/client"
+	"github.com/justinbarrick/go-matrix/pkg/client/server_administration"
+)
+
+// The server name of a user ID such as @bot:example.com, or server unchanged if it is
+// not a user ID.
+func serverName(server string) string {
+	if i := strings.Index(server, ":"); strings.HasPrefix(server, "@") && i >= 0 {
+		return server[i+1:]
+	}
+	return server
+}
+
+// Parse a homeserver base URL. A server name or user ID, like the bare hosts in configs
+// written before servers were discovered, is assumed to be served over https.
+func parseServerUrl(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "https://" + serverName(server)
+	}
+
+	parsed, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid server URL %s: %s", server, err)
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("Invalid server URL %s", server)
+	}
+
+	return parsed, nil
+}
+
+// Create a go-openapi runtime that sends requests to a homeserver with transport.
+func newRuntime(server string, transport http.RoundTripper) (*httptransport.Runtime, error) {
+	serverUrl, err := parseServerUrl(server)
+	if err != nil {
+		return nil, err
+	}
+
+	httpRuntime := httptransport.New(serverUrl.Host, serverUrl.Path, []string{serverUrl.Scheme})
+	httpRuntime.Transport = transport
+	return httpRuntime, nil
+}
+
+// A client that sends requests with httpRuntime.
+func clientFor(httpRuntime *httptransport.Runtime) *client.MatrixClientServer {
+	return client.New(botTransport{httpRuntime}, nil)
+}
+
+// Whether a homeserver supports a version of the client-server API we can talk to.
+func supportsSpec(versions []string) bool {
+	for _, version := range versions {
+		if strings.HasPrefix(version, "r0.") || strings.HasPrefix(version, "v1.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up the base URL of a server name in its /.well-known/matrix/client. A server
+// without one is expected to serve the client API itself.
+func (b *Bot) wellKnownBaseUrl(c context.Context, name string) (string, error) {
+	httpRuntime, err := newRuntime(name, b.httpRuntime.Transport)
+	if err != nil {
+		return "", err
+	}
+
+	serverClient := clientFor(httpRuntime)
+	wellKnown, err := serverClient.ServerAdministration.GetWellknown(server_administration.NewGetWellknownParamsWithContext(c))
+
+	var matrixErr *Error
+	if errors.As(err, &matrixErr) && matrixErr.StatusCode == http.StatusNotFound {
+		return "https://" + name, nil
+	} else if err != nil {
+		return "", fmt.Errorf("Could not fetch .well-known for %s: %w", name, err)
+	}
+
+	homeserver := wellKnown.Payload.MHomeserver
+	if homeserver == nil || homeserver.BaseURL == nil || *homeserver.BaseURL == "" {
+		return "", fmt.Errorf("The .well-known for %s has no homeserver base URL", name)
+	}
+
+	return strings.TrimRight(*homeserver.BaseURL, "/"), nil
+}
+
+// Resolve the bot's server, which may be a server name such as example.com or a user ID
+// such as @bot:example.com, to the base URL of its client API using the server's
+// .well-known. The server must support a version of the spec that we support. The base
+// URL replaces Server so that it is saved with the bot. A server that is already a URL
+// is only checked. Call it before the bot is used.
+func (b *Bot) DiscoverServer(c context.Context) error {
+	baseUrl := b.Server
+	if !strings.Contains(baseUrl, "://") {
+		var err error
+		if baseUrl, err = b.wellKnownBaseUrl(c, serverName(b.Server)); err != nil {
+			return err
+		}
+	}
+
+	httpRuntime, err := newRuntime(baseUrl, b.httpRuntime.Transport)
+	if err != nil {
+		return err
+	}
+
+	serverClient := clientFor(httpRuntime)
+	versions, err := serverClient.ServerAdministration.GetVersions(server_administration.NewGetVersionsParamsWithContext(c))
+	if err != nil {
+		return fmt.Errorf("Could not get the versions of %s: %w", baseUrl, err)
+	}
+
+	if !supportsSpec(versions.Payload.Versions) {
+		return fmt.Errorf("%s does not support a known spec version: %s", baseUrl, strings.Join(versions.Payload.Versions, ", "))
+	}
+
+	b.lock.Lock()
+	b.Server = baseUrl
+	b.lock.Unlock()
+
+	b.httpRuntime = httpRuntime
+	b.client = serverClient
+	return nil
+}
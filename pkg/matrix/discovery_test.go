@@ -0,0 +1,97 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverServer(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/.well-known/matrix/client":
+			fmt.Fprintf(w, `{"m.homeserver": {"base_url": "%s/matrix/"}}`, server.URL)
+		case "/matrix/_matrix/client/versions":
+			fmt.Fprint(w, `{"versions": ["r0.5.0", "r0.6.1"]}`)
+		case "/matrix/_matrix/client/unstable/sync":
+			fmt.Fprint(w, `{"next_batch": "s1"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	bot := newTestBot(t, server)
+	bot.Server = "@bot:" + serverUrl.Host
+
+	assert.Nil(t, bot.DiscoverServer(context.TODO()))
+	assert.Equal(t, server.URL+"/matrix", bot.Server)
+
+	// Requests go to the discovered base URL.
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	// The base URL is saved and used when the bot is loaded.
+	data, err := encodeBot(*bot, "")
+	assert.Nil(t, err)
+	loaded, err := decodeBot(data, "")
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/matrix", loaded.Server)
+	assert.Equal(t, "/matrix", loaded.httpRuntime.BasePath)
+}
+
+func TestDiscoverServerWithoutWellKnown(t *testing.T) {
+	versions := `{"versions": ["r0.6.1"]}`
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/versions":
+			fmt.Fprint(w, versions)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`)
+		}
+	}))
+	defer server.Close()
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	bot := newTestBot(t, server)
+	assert.Nil(t, bot.DiscoverServer(context.TODO()))
+	assert.Equal(t, "https://"+serverUrl.Host, bot.Server)
+
+	// Servers that only support spec versions we do not know are rejected.
+	versions = `{"versions": ["v2.0"]}`
+	err = bot.DiscoverServer(context.TODO())
+	assert.Equal(t, fmt.Sprintf("https://%s does not support a known spec version: v2.0", serverUrl.Host), err.Error())
+}
+
+func TestParseServerUrl(t *testing.T) {
+	for server, expected := range map[string]string{
+		"example.com":               "https://example.com",
+		"example.com:8448":          "https://example.com:8448",
+		"@bot:example.com":          "https://example.com",
+		"http://localhost:8008":     "http://localhost:8008",
+		"https://example.com/proxy": "https://example.com/proxy",
+	} {
+		serverUrl, err := parseServerUrl(server)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, serverUrl.String())
+	}
+
+	_, err := parseServerUrl("ftp://example.com")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,152 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-openapi/runtime"
+)
+
+// An error response from the homeserver. Errors returned by the bot wrap it, use
+// errors.As to get at it:
+//
+//	var matrixErr *matrix.Error
+//	if errors.As(err, &matrixErr) && matrixErr.ErrCode == "M_FORBIDDEN" {
+//
+// It in turn wraps the error returned by the generated client, if there was one.
+type Error struct {
+	// The HTTP status code of the response.
+	StatusCode int
+	// The Matrix error code, such as M_FORBIDDEN or M_LIMIT_EXCEEDED.
+	ErrCode string
+	// The human-readable error message.
+	Message string
+	// How long the server asked us to wait before retrying, 0 if it did not say.
+	RetryAfterMs int64
+	// Set with M_UNKNOWN_TOKEN if the access token expired or the server logged the
+	// device out without deleting it, the bot can log in again and keep its keys.
+	SoftLogout bool
+	// The decoded response body, for the fields of errors such as user-interactive
+	// authentication.
+	body map[string]interface{}
+	err  error
+}
+
+func (e *Error) Error() string {
+	if e.ErrCode == "" {
+		return fmt.Sprintf("[%d] %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("[%d] %s: %s", e.StatusCode, e.ErrCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Build an Error from the body of a non-2xx response. Not every status code is in the
+// generated *_responses types and the ones that are drop the body when they are
+// unexpected, so the body is decoded for all of them.
+func newError(statusCode int, data []byte, err error) *Error {
+	e := &Error{
+		StatusCode: statusCode,
+		body:       map[string]interface{}{},
+		err:        err,
+	}
+
+	if json.Unmarshal(data, &e.body) != nil {
+		return e
+	}
+
+	e.ErrCode = contentString(e.body, "errcode")
+	e.Message = contentString(e.body, "error")
+	if ms, ok := contentNumber(e.body, "retry_after_ms"); ok {
+		e.RetryAfterMs = int64(ms)
+	}
+	e.SoftLogout, _ = e.body["soft_logout"].(bool)
+
+	return e
+}
+
+// Return the Matrix error code of an error returned by the bot, or an empty string if
+// it was not an error response from the homeserver.
+func ErrCode(err error) string {
+	var matrixErr *Error
+	if errors.As(err, &matrixErr) {
+		return matrixErr.ErrCode
+	}
+	return ""
+}
+
+// A runtime.ClientTransport that turns every error response into an Error, and
+// re-authenticates and retries requests made by a bot that was soft logged out.
+type botTransport struct {
+	runtime.ClientTransport
+}
+
+func (t botTransport) Submit(operation *runtime.ClientOperation) (interface{}, error) {
+	op := *operation
+	op.Reader = errorReader{operation.Reader}
+
+	bot, ok := op.AuthInfo.(*Bot)
+	if !ok {
+		return t.ClientTransport.Submit(&op)
+	}
+
+	accessToken := bot.accessToken()
+	result, err := t.ClientTransport.Submit(&op)
+
+	var matrixErr *Error
+	if !errors.As(err, &matrixErr) || matrixErr.ErrCode != "M_UNKNOWN_TOKEN" || !matrixErr.SoftLogout {
+		return result, err
+	}
+
+	c := op.Context
+	if c == nil {
+		c = context.Background()
+	}
+
+	if reauthErr := bot.reauthenticate(c, accessToken); reauthErr != nil {
+		return result, fmt.Errorf("%w, could not log in again: %s", err, reauthErr)
+	}
+
+	return t.ClientTransport.Submit(&op)
+}
+
+type errorReader struct {
+	reader runtime.ClientResponseReader
+}
+
+func (r errorReader) ReadResponse(response runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+	if response.Code() >= 200 && response.Code() <= 299 {
+		return r.reader.ReadResponse(response, consumer)
+	}
+
+	data, err := ioutil.ReadAll(response.Body())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.reader.ReadResponse(bufferedResponse{response, data}, consumer)
+	if err != nil {
+		return result, newError(response.Code(), data, err)
+	}
+
+	return result, nil
+}
+
+// A response whose body has already been read.
+type bufferedResponse struct {
+	runtime.ClientResponse
+	body []byte
+}
+
+func (b bufferedResponse) Body() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(b.body))
+}
@@ -0,0 +1,69 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/room_participation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorFromResponse(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/room_keys/version":
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 2000}`)
+		case "/_matrix/client/unstable/rooms/!room:example.org/state/m.room.encryption":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_NOT_FOUND", "error": "Event not found"}`)
+		case "/_matrix/client/unstable/sync":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errcode": "M_FORBIDDEN", "error": "You are not in this room"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	// A status code that the generated client does not know about.
+	err := bot.SendEvent(context.TODO(), "!room:example.org", "m.room.message", map[string]string{})
+	matrixErr := &Error{}
+	assert.True(t, errors.As(err, &matrixErr))
+	assert.Equal(t, http.StatusForbidden, matrixErr.StatusCode)
+	assert.Equal(t, "M_FORBIDDEN", matrixErr.ErrCode)
+	assert.Equal(t, "You are not in this room", matrixErr.Message)
+	assert.Equal(t, "Could not send message: [403] M_FORBIDDEN: You are not in this room", err.Error())
+
+	// A status code that the generated client returns its own error type for.
+	params := room_participation.NewGetRoomStateByTypeParamsWithContext(context.TODO())
+	params.SetRoomID("!room:example.org")
+	params.SetEventType("m.room.encryption")
+	_, err = bot.client.RoomParticipation.GetRoomStateByType(params, bot)
+	assert.Equal(t, "M_NOT_FOUND", ErrCode(err))
+	notFound := &room_participation.GetRoomStateByTypeNotFound{}
+	assert.True(t, errors.As(err, &notFound))
+
+	// Endpoints without a generated client.
+	err = bot.doJSON(context.TODO(), "GET", "/room_keys/version", nil, nil)
+	assert.True(t, errors.As(err, &matrixErr))
+	assert.Equal(t, "M_LIMIT_EXCEEDED", matrixErr.ErrCode)
+	assert.Equal(t, int64(2000), matrixErr.RetryAfterMs)
+
+	// Responses without a Matrix error.
+	err = bot.SyncOnce(context.TODO())
+	assert.True(t, errors.As(err, &matrixErr))
+	assert.Equal(t, http.StatusBadGateway, matrixErr.StatusCode)
+	assert.Equal(t, "", ErrCode(err))
+	assert.Equal(t, "Could not sync: [502] Bad Gateway", err.Error())
+
+	assert.Equal(t, "", ErrCode(fmt.Errorf("not a matrix error")))
+}
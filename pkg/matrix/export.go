@@ -0,0 +1,172 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	exportHeader  = "-----BEGIN MEGOLM SESSION DATA-----"
+	exportFooter  = "-----END MEGOLM SESSION DATA-----"
+	exportVersion = 1
+	exportRounds  = 500000
+	exportLine    = 96
+)
+
+// Derive the AES and HMAC keys of a key export from its passphrase.
+func exportKeys(passphrase string, salt []byte, rounds int) (aesKey, macKey []byte) {
+	keys := pbkdf2.Key([]byte(passphrase), salt, rounds, 64, sha512.New)
+	return keys[:32], keys[32:]
+}
+
+// Export all inbound group sessions in the passphrase protected format that Element
+// and other clients can import.
+func (b *Bot) ExportRoomKeys(passphrase string) ([]byte, error) {
+	sessions := []map[string]interface{}{}
+
+	b.lock.Lock()
+	for key, session := range b.inboundGroupSessions {
+		roomId, sessionId, exported, err := exportSession(key, b.senderClaimedKeys[key], session)
+		if err != nil {
+			b.lock.Unlock()
+			return nil, err
+		}
+
+		exported["room_id"] = roomId
+		exported["session_id"] = sessionId
+		sessions = append(sessions, exported)
+	}
+	b.lock.Unlock()
+
+	plaintext, err := json.Marshal(sessions)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode sessions: %s", err)
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	// Clear bit 63 so that the counter cannot overflow into the nonce.
+	iv[8] &= 0x7f
+
+	aesKey, macKey := exportKeys(passphrase, salt, exportRounds)
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	data := []byte{exportVersion}
+	data = append(data, salt...)
+	data = append(data, iv...)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], exportRounds)
+	data = append(data, ciphertext...)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	data = mac.Sum(data)
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	out := bytes.NewBufferString(exportHeader + "\n")
+	for i := 0; i < len(encoded); i += exportLine {
+		end := i + exportLine
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		out.WriteString(encoded[i:end] + "\n")
+	}
+	out.WriteString(exportFooter + "\n")
+
+	return out.Bytes(), nil
+}
+
+// Import the sessions in a key export created by ExportRoomKeys or another client.
+// Returns the number of sessions imported.
+func (b *Bot) ImportRoomKeys(export []byte, passphrase string) (int, error) {
+	plaintext, err := decryptRoomKeyExport(export, passphrase)
+	if err != nil {
+		return 0, err
+	}
+
+	sessions := []map[string]interface{}{}
+	if err := json.Unmarshal(plaintext, &sessions); err != nil {
+		return 0, fmt.Errorf("Could not decode sessions: %s", err)
+	}
+
+	imported := 0
+	for _, session := range sessions {
+		roomId := contentString(session, "room_id")
+		sessionId := contentString(session, "session_id")
+
+		if _, err := b.importSession(roomId, sessionId, session); err != nil {
+			return imported, fmt.Errorf("Could not import session %s: %s", sessionId, err)
+		}
+		imported++
+	}
+
+	return imported, b.saveCryptoState()
+}
+
+// Check the passphrase of a key export and return the JSON encoded sessions in it.
+func decryptRoomKeyExport(export []byte, passphrase string) ([]byte, error) {
+	text := strings.TrimSpace(string(export))
+	if !strings.HasPrefix(text, exportHeader) || !strings.HasSuffix(text, exportFooter) {
+		return nil, fmt.Errorf("Not a Megolm key export")
+	}
+
+	encoded := strings.Join(strings.Fields(text[len(exportHeader):len(text)-len(exportFooter)]), "")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode key export: %s", err)
+	}
+
+	headerLength := 1 + 16 + 16 + 4
+	if len(data) < headerLength+sha256.Size || data[0] != exportVersion {
+		return nil, fmt.Errorf("Unsupported key export")
+	}
+
+	salt := data[1:17]
+	iv := data[17:33]
+	rounds := binary.BigEndian.Uint32(data[33:37])
+	ciphertext := data[headerLength : len(data)-sha256.Size]
+
+	aesKey, macKey := exportKeys(passphrase, salt, int(rounds))
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data[:len(data)-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), data[len(data)-sha256.Size:]) {
+		return nil, fmt.Errorf("Wrong passphrase or corrupted key export")
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+
+	return plaintext, nil
+}
@@ -0,0 +1,102 @@
+package matrix
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomKeyExportRoundTrip(t *testing.T) {
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	bot.addInboundGroupSession("!room:example.org", "alicekey", "aliceed", inbound)
+
+	export, err := bot.ExportRoomKeys("correct horse")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(export), "-----BEGIN MEGOLM SESSION DATA-----\n"))
+
+	restored, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	_, err = restored.ImportRoomKeys(export, "wrong horse")
+	assert.NotNil(t, err)
+
+	count, err := restored.ImportRoomKeys(export, "correct horse")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	_, ciphertext := outbound.Encrypt("hello")
+	key := groupSessionKey("!room:example.org", "alicekey", outbound.GetSessionID())
+	plaintext, _, err := restored.inboundGroupSessions[key].Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", plaintext)
+	assert.Equal(t, "aliceed", restored.senderClaimedKeys[key])
+}
+
+// Key exports from matrix-react-sdk's MegolmExportEncryption tests.
+func TestDecryptElementRoomKeyExport(t *testing.T) {
+	for _, test := range []struct {
+		export     string
+		passphrase string
+		plaintext  string
+	}{
+		{
+			export: `-----BEGIN MEGOLM SESSION DATA-----
+AXNhbHRzYWx0c2FsdHNhbHSIiIiIiIiIiIiIiIiIiIiIAAAACmIRUW2OjZ3L2l6j9h0lHlV3M2dx
+cissyYBxjsfsAndErh065A8=
+-----END MEGOLM SESSION DATA-----`,
+			passphrase: "password",
+			plaintext:  "plain",
+		},
+		{
+			export: `-----BEGIN MEGOLM SESSION DATA-----
+AW1vcmVzYWx0bW9yZXNhbHT//////////wAAAAAAAAAAAAAD6KyBpe1Niv5M5NPm4ZATsJo5nghk
+KYu63a0YQ5DRhUWEKk7CcMkrKnAUiZny
+-----END MEGOLM SESSION DATA-----`,
+			passphrase: "betterpassword",
+			plaintext:  "Hello, World",
+		},
+	} {
+		plaintext, err := decryptRoomKeyExport([]byte(test.export), test.passphrase)
+		assert.Nil(t, err)
+		assert.Equal(t, test.plaintext, string(plaintext))
+
+		_, err = decryptRoomKeyExport([]byte(test.export), "wrong")
+		assert.NotNil(t, err)
+	}
+}
+
+// A session in the layout Element exports, with a session key exported by libolm from
+// its group session tests, can decrypt libolm's message.
+func TestImportElementSession(t *testing.T) {
+	sessions := []map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(`[{
+		"algorithm": "m.megolm.v1.aes-sha2",
+		"forwarding_curve25519_key_chain": [],
+		"room_id": "!room:example.org",
+		"sender_key": "alicecurve",
+		"sender_claimed_keys": {"ed25519": "aliceed"},
+		"session_id": "DRt2DUEOrg/H+yUGjDTqryf8H1YF/BZjI04HwOVSZcY",
+		"session_key": "AQAAAAAwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMzQ1Njc4OUFCREVGMDEyMzQ1Njc4OUFCQ0RFRjAxMjM0NTY3ODlBQkRFRjAxMjM0NTY3ODlBQkNERUYwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMw0bdg1BDq4Px/slBow06q8n/B9WBfwWYyNOB8DlUmXG"
+	}]`), &sessions))
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	key, err := bot.importSession("!room:example.org", "DRt2DUEOrg/H+yUGjDTqryf8H1YF/BZjI04HwOVSZcY", sessions[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "aliceed", bot.senderClaimedKeys[key])
+
+	plaintext, index, err := bot.inboundGroupSessions[key].Decrypt("AwgAEhAcbh6UpbByoyZxufQ+h2B+8XHMjhR69G8F4+qjMaFlnIXusJZX3r8LnRORG9T3DXFdbVuvIWrLyRfm4i8QRbe8VPwGRFG57B1CtmxanuP8bHtnnYqlwPsD")
+	assert.Nil(t, err)
+	assert.Equal(t, "Message", plaintext)
+	assert.Equal(t, uint32(0), index)
+}
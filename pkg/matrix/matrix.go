@@ -3,7 +3,6 @@ package matrix
 import (
 	"context"
 	httptransport "github.com/go-openapi/runtime/client"
-	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
@@ -17,16 +16,16 @@ import (
 	"github.com/justinbarrick/go-matrix/pkg/client/room_participation"
 	"github.com/justinbarrick/go-matrix/pkg/client/send_to_device_messaging"
 	"github.com/justinbarrick/go-matrix/pkg/client/session_management"
-	"github.com/justinbarrick/go-matrix/pkg/client/user_data"
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
 	"github.com/justinbarrick/go-matrix/pkg/models"
 	"jaytaylor.com/html2text"
 
 	"encoding/json"
 	"fmt"
 	libolm "github.com/justinbarrick/libolm-go"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 )
 
 var (
@@ -43,32 +42,21 @@ var (
 )
 
 func Serialize(b Bot, path string) error {
-	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
-		return err
-	}
-
-	f, err := os.Create(path)
+	key, err := ConfigKey()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(b)
+
+	return SerializeWithKey(b, path, key)
 }
 
 func Unserialize(path string) (Bot, error) {
-	b := Bot{}
-
-	f, err := os.Open(path)
+	key, err := ConfigKey()
 	if err != nil {
-		return b, err
+		return Bot{}, err
 	}
-	defer f.Close()
 
-	if err := json.NewDecoder(f).Decode(&b); err != nil {
-		return b, err
-	}
-
-	return b, b.Init()
+	return UnserializeWithKey(path, key)
 }
 
 // Represents an encrypted event that will be sent directly to a device.
@@ -80,18 +68,77 @@ type DirectEvent struct {
 	Ciphertext map[string]map[string]interface{} `json:"ciphertext"`
 }
 
-// A bot instance that can send messages to Matrix channels.
+// A bot instance that can send messages to Matrix channels. A bot is safe for concurrent
+// use, encrypted sends to different rooms proceed in parallel while sends to the same
+// room are serialized so that they keep the order of the room's Megolm ratchet.
 type Bot struct {
-	UserId       string         `json:"userId"`
-	DeviceId     string         `json:"deviceId"`
-	AccessToken  string         `json:"accessToken"`
-	Server       string         `json:"server"`
-	Olm          *libolm.Matrix `json:"olm"`
-	client       *client.MatrixClientServer
-	shookDevices map[string]bool
-	joinedRooms map[string]bool
-	groupSessions map[string]libolm.GroupSession
-	sessions     []libolm.UserSession
+	UserId        string            `json:"userId"`
+	DeviceId      string            `json:"deviceId"`
+	AccessToken   string            `json:"accessToken"`
+	RefreshToken  string            `json:"refreshToken,omitempty"`
+	Server        string            `json:"server"`
+	Olm           *libolm.Matrix    `json:"olm"`
+	Transport     *TransportOptions `json:"transport,omitempty"`
+	client        *client.MatrixClientServer
+	httpRuntime   *httptransport.Runtime
+	shookDevices  map[string]map[string]bool
+	joinedRooms   map[string]bool
+	groupSessions map[string]*megolm.OutboundSession
+	handlers      map[string][]EventHandler
+	syncStore     SyncStore
+	syncErrors    func(error)
+	nextBatch     string
+	cryptoStore   CryptoStore
+	// The key the crypto state is encrypted and Olm sessions are pickled with, the config key
+	// if one is given.
+	pickleKey string
+	// Encrypts the crypto state with pickleKey, created on the first save.
+	cryptoStateSealer *configSealer
+	// Outbound group session rotation settings, keyed by room ID.
+	rotationPolicies map[string]RotationPolicy
+	// Room IDs of the aliases resolved by ResolveRoom.
+	roomAliases map[string]cachedAlias
+	// Set when an inbound Olm session used up a one-time key and the account must be saved.
+	accountChanged bool
+	// Whether joinedRooms was seeded from the server, sync keeps it current after that.
+	joinedRoomsLoaded bool
+	// Devices seen in /keys/query responses, keyed by user ID and device ID.
+	devices        map[string]map[string]*Device
+	keySharePolicy KeySharePolicy
+	// Validated device keys of the users we share rooms with, kept up to date by sync.
+	deviceKeyCache    map[string]models.QueryKeysOKBodyDeviceKeysAdditionalProperties
+	deviceListToken   string
+	deviceListsSynced bool
+	// SAS verifications in progress, keyed by transaction ID.
+	verifications map[string]*sasVerification
+	// Our cross-signing keys, nil until BootstrapCrossSigning is called.
+	crossSigningKeys *CrossSigningKeys
+	// The server-side key backup, nil until one is created or restored.
+	keyBackup *KeyBackup
+	// Inbound group sessions that have been uploaded to the key backup.
+	backedUpSessions map[string]bool
+	// Olm sessions with other devices, keyed by their curve25519 identity key.
+	olmSessions map[string][]libolm.Session
+	// Megolm sessions for decrypting room events, keyed by groupSessionKey.
+	inboundGroupSessions map[string]*megolm.InboundSession
+	// The ed25519 keys of the devices that sent the inbound group sessions.
+	senderClaimedKeys map[string]string
+	// Event IDs of decrypted Megolm messages by session and index, to detect replays.
+	messageIndexes map[string]map[uint32]string
+	// Set when messageIndexes changed since the crypto state was last saved.
+	messageIndexesChanged bool
+	// Where credentials are saved when they change, see SetConfigStore.
+	configStore       ConfigStore
+	configKey         string
+	softLogoutHandler SoftLogoutHandler
+	// Guards the maps above and the Olm and Megolm sessions. Network requests are made
+	// without holding it. Pointers so that copies of the bot share them, like its maps.
+	lock *sync.Mutex
+	// Serializes encrypted sends and session rotation per room, keyed by room ID. A room
+	// lock is always taken before lock.
+	roomLocks map[string]*sync.Mutex
+	// Serializes re-authentication after the bot was soft logged out.
+	authLock *sync.Mutex
 }
 
 // Initialize a new bot instance. Most provide either username+password or accessToken.
@@ -105,12 +152,26 @@ func NewBot(server string) (Bot, error) {
 
 // Initialize a bot from the configuration.
 func (b *Bot) Init() (err error) {
-	transport := client.DefaultTransportConfig()
-	b.client = client.NewHTTPClientWithConfig(nil, transport.WithHost(b.Server))
-	b.client.Transport.(*httptransport.Runtime).Transport = &ochttp.Transport{}
-	b.shookDevices = map[string]bool{}
+	if err := b.SetTransportOptions(b.Transport); err != nil {
+		return err
+	}
+	b.shookDevices = map[string]map[string]bool{}
 	b.joinedRooms = map[string]bool{}
-	b.groupSessions = map[string]libolm.GroupSession{}
+	b.groupSessions = map[string]*megolm.OutboundSession{}
+	b.handlers = map[string][]EventHandler{}
+	b.olmSessions = map[string][]libolm.Session{}
+	b.inboundGroupSessions = map[string]*megolm.InboundSession{}
+	b.senderClaimedKeys = map[string]string{}
+	b.backedUpSessions = map[string]bool{}
+	b.messageIndexes = map[string]map[uint32]string{}
+	b.rotationPolicies = map[string]RotationPolicy{}
+	b.roomAliases = map[string]cachedAlias{}
+	b.devices = map[string]map[string]*Device{}
+	b.deviceKeyCache = map[string]models.QueryKeysOKBodyDeviceKeysAdditionalProperties{}
+	b.verifications = map[string]*sasVerification{}
+	b.lock = &sync.Mutex{}
+	b.roomLocks = map[string]*sync.Mutex{}
+	b.authLock = &sync.Mutex{}
 
 	return view.Register(
 		&view.View{
@@ -149,97 +210,94 @@ func (b *Bot) Init() (err error) {
 			Aggregation: view.Count(),
 			TagKeys:     []tag.Key{destIdTag, destDeviceIdTag},
 		},
+		&view.View{
+			Name:        "matrix_request_retries",
+			Description: "number of requests to matrix servers that were retried",
+			Measure:     retryCount,
+			Aggregation: view.Count(),
+		},
 	)
 }
 
+// Get the lock that serializes encrypted sends to a room.
+func (b *Bot) roomLock(room_id string) *sync.Mutex {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.roomLocks[room_id]; !ok {
+		b.roomLocks[room_id] = &sync.Mutex{}
+	}
+
+	return b.roomLocks[room_id]
+}
+
 // Implement ClientAuthInfoWriter by adding the bot's access token to all API requests.
+// It is sent in a header rather than the query string so that it does not end up in
+// logs and traces.
 func (b *Bot) AuthenticateRequest(request runtime.ClientRequest, registry strfmt.Registry) error {
-	if b.AccessToken == "" {
+	accessToken := b.accessToken()
+	if accessToken == "" {
 		return fmt.Errorf("No access token set, please login.")
 	}
 
-	request.SetQueryParam("access_token", b.AccessToken)
-	return nil
+	return bearerToken(accessToken).AuthenticateRequest(request, registry)
 }
 
-// Login with a username and password, not needed if accessToken is provided.
-func (b *Bot) Register(c context.Context, username, password string) error {
-	registerParams := user_data.NewRegisterParamsWithContext(c)
-	registerParams.SetBody(&models.RegisterParamsBody{
-		Username: username,
-		Password: password,
-	})
+func (b *Bot) accessToken() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	registerOk, err := b.client.UserData.Register(registerParams)
-	if err == nil {
-		b.AccessToken = registerOk.Payload.AccessToken
-		b.DeviceId = registerOk.Payload.DeviceID
-		b.UserId = *registerOk.Payload.UserID
-		return nil
-	}
+	return b.AccessToken
+}
 
-	unauthorized, ok := err.(*user_data.RegisterUnauthorized)
-	if !ok {
-		return fmt.Errorf("Could not register: %s", err)
-	}
+// Register a new user account. The server may only require m.login.dummy, use
+// RegisterWithAuth for servers that need more to register.
+func (b *Bot) Register(c context.Context, username, password string) error {
+	return b.RegisterWithAuth(c, username, password, nil)
+}
 
-	loginType := "m.login.dummy"
+// Register a new user account, completing the user-interactive authentication stages the
+// server asks for, such as a registration token or accepting its terms, with stages.
+func (b *Bot) RegisterWithAuth(c context.Context, username, password string, stages AuthStages) error {
+	body := map[string]interface{}{
+		"username":                    username,
+		"password":                    password,
+		"initial_device_display_name": username,
+		"refresh_token":               true,
+	}
 
-	registerParams.SetBody(&models.RegisterParamsBody{
-		Username:                 username,
-		Password:                 password,
-		InitialDeviceDisplayName: username,
-		Auth: &models.RegisterParamsBodyAuth{
-			Session: unauthorized.Payload.Session,
-			Type:    &loginType,
-		},
+	result := loginResponse{}
+	err := b.authenticate(c, stages, func(auth map[string]interface{}) error {
+		if auth != nil {
+			body["auth"] = auth
+		}
+		return b.doUnauthenticatedJSON(c, "POST", "/register", body, &result)
 	})
-
-	registerOk, err = b.client.UserData.Register(registerParams)
 	if err != nil {
-		return fmt.Errorf("Could not login: %s", err)
+		return fmt.Errorf("Could not register: %w", err)
 	}
 
-	b.AccessToken = registerOk.Payload.AccessToken
-	b.DeviceId = registerOk.Payload.DeviceID
-	b.UserId = *registerOk.Payload.UserID
+	b.lock.Lock()
+	b.UserId = result.UserId
+	b.DeviceId = result.DeviceId
+	b.AccessToken = result.AccessToken
+	b.RefreshToken = result.RefreshToken
 	b.Olm = libolm.NewMatrix()
+	b.lock.Unlock()
 
-	err = b.UploadKeys(c)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return b.UploadKeys(c)
 }
 
 // Login with a username and password, not needed if accessToken is provided.
 func (b *Bot) Login(c context.Context, username, password string) error {
-	loginType := "m.login.password"
-
-	loginParams := session_management.NewLoginParamsWithContext(c)
-	loginParams.SetBody(&models.LoginParamsBody{
-		Type:     &loginType,
-		User:     username,
-		Password: password,
+	return b.login(c, nil, map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]string{
+			"type": "m.id.user",
+			"user": username,
+		},
+		"password": password,
 	})
-
-	loginOk, err := b.client.SessionManagement.Login(loginParams)
-	if err != nil {
-		return fmt.Errorf("Could not login: %s", err)
-	}
-
-	b.AccessToken = loginOk.Payload.AccessToken
-	b.DeviceId = loginOk.Payload.DeviceID
-	b.UserId = loginOk.Payload.UserID
-	b.Olm = libolm.NewMatrix()
-
-	err = b.UploadKeys(c)
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
 // Logout an access token.
@@ -265,7 +323,7 @@ func (b *Bot) UploadKeys(c context.Context) error {
 
 	_, err = b.client.EndToEndEncryption.UploadKeys(uploadKeys, b)
 	if err != nil {
-		return fmt.Errorf("Could not upload keys: %s", err)
+		return fmt.Errorf("Could not upload keys: %w", err)
 	}
 
 	err = b.Olm.MarkPublished()
@@ -276,46 +334,73 @@ func (b *Bot) UploadKeys(c context.Context) error {
 	return nil
 }
 
-// Join a room.
+// Join a room, unless the bot is already in it.
 func (b *Bot) JoinRoom(c context.Context, room_id string) error {
-	if b.joinedRooms[room_id] {
+	b.lock.Lock()
+	joined, loaded := b.joinedRooms[room_id], b.joinedRoomsLoaded
+	b.lock.Unlock()
+
+	// If the joined rooms cannot be listed the join below fails the same way.
+	if !joined && !loaded {
+		if _, err := b.JoinedRooms(c); err == nil {
+			joined = b.IsJoined(room_id)
+		}
+	}
+
+	if joined {
 		return nil
 	}
 
 	joinParams := room_membership.NewJoinRoomByIDParamsWithContext(c)
 	joinParams.SetRoomID(room_id)
 
-	_, err := b.client.RoomMembership.JoinRoomByID(joinParams, b)
-
-	if err != nil {
-		b.joinedRooms[room_id] = true
+	if _, err := b.client.RoomMembership.JoinRoomByID(joinParams, b); err != nil {
+		return fmt.Errorf("Could not join %s: %w", room_id, err)
 	}
 
-	return err
+	b.lock.Lock()
+	b.joinedRooms[room_id] = true
+	b.lock.Unlock()
+
+	return nil
 }
 
-// Get a list of all members in a room.
+// Get a list of all joined members in a room. Members that left or were banned must
+// not receive room keys.
 func (b *Bot) GetRoomMembers(c context.Context, room_id string) ([]string, error) {
-	roomParams := room_participation.NewGetMembersByRoomParamsWithContext(c)
+	roomParams := room_participation.NewGetJoinedMembersByRoomParamsWithContext(c)
 	roomParams.SetRoomID(room_id)
 
-	roomMembers, err := b.client.RoomParticipation.GetMembersByRoom(roomParams, b)
+	roomMembers, err := b.client.RoomParticipation.GetJoinedMembersByRoom(roomParams, b)
 	if err != nil {
-		return nil, fmt.Errorf("Error fetching room members: %s", err)
+		return nil, fmt.Errorf("Error fetching room members: %w", err)
 	}
 
 	members := []string{}
 
-	for _, chunk := range roomMembers.Payload.Chunk {
-		members = append(members, chunk.GetMembersByRoomOKBodyChunkItemsAllOf0.GetMembersByRoomOKBodyChunkItemsAllOf0AllOf0.GetMembersByRoomOKBodyChunkItemsAllOf0AllOf0AllOf0.GetMembersByRoomOKBodyChunkItemsAllOf0AllOf0AllOf0AllOf0.GetMembersByRoomOKBodyChunkItemsAllOf0AllOf0AllOf0AllOf0AllOf0.StateKey)
+	for userId := range roomMembers.Payload.Joined {
+		members = append(members, userId)
 	}
 
+	sort.Strings(members)
 	return members, nil
 }
 
 // Claim a one-time key from each member of the room so that we can send them a group
 // session key.
 func (b *Bot) ClaimRoomMemberKeys(c context.Context, room_id string) (*models.ClaimKeysOKBody, models.QueryKeysOKBodyDeviceKeys, error) {
+	members, deviceKeys, err := b.queryRoomDeviceKeys(c, room_id)
+	if err != nil {
+		return nil, deviceKeys, err
+	}
+
+	claim, err := b.claimRoomDeviceKeys(c, room_id, members, deviceKeys)
+	return claim, deviceKeys, err
+}
+
+// Get the joined members of a room and the keys of their devices that we may share
+// room keys with.
+func (b *Bot) queryRoomDeviceKeys(c context.Context, room_id string) ([]string, models.QueryKeysOKBodyDeviceKeys, error) {
 	deviceKeys := models.QueryKeysOKBodyDeviceKeys{}
 
 	members, err := b.GetRoomMembers(c, room_id)
@@ -323,27 +408,26 @@ func (b *Bot) ClaimRoomMemberKeys(c context.Context, room_id string) (*models.Cl
 		return nil, deviceKeys, err
 	}
 
-	wantedDeviceKeys := map[string][]string{}
-	for _, destId := range members {
-		wantedDeviceKeys[destId] = []string{}
+	deviceKeys, err = b.queryDeviceKeys(c, members)
+	if err != nil {
+		return nil, deviceKeys, err
 	}
 
-	queryParams := end_to_end_encryption.NewQueryKeysParamsWithContext(c)
-	queryParams.SetQuery(&models.QueryKeysParamsBody{
-		DeviceKeys: wantedDeviceKeys,
-	})
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	query, err := b.client.EndToEndEncryption.QueryKeys(queryParams, b)
-	if err != nil {
-		return nil, deviceKeys, fmt.Errorf("Error fetching keys: %s", err)
-	}
+	return members, b.trustedDeviceKeys(deviceKeys), nil
+}
 
-	deviceKeys = query.Payload.DeviceKeys
+// Claim a one-time key from each device in the room that has not received our group
+// session yet.
+func (b *Bot) claimRoomDeviceKeys(c context.Context, room_id string, members []string, deviceKeys models.QueryKeysOKBodyDeviceKeys) (*models.ClaimKeysOKBody, error) {
 	wantedKeys := map[string]map[string]string{}
 
+	b.lock.Lock()
 	for _, destId := range members {
 		for destDeviceId := range deviceKeys[destId] {
-			if b.shookDevices[fmt.Sprintf("%s:%s", room_id, destDeviceId)] {
+			if b.shookDevices[room_id][deviceKey(destId, destDeviceId)] {
 				continue
 			}
 
@@ -359,6 +443,7 @@ func (b *Bot) ClaimRoomMemberKeys(c context.Context, room_id string) (*models.Cl
 			wantedKeys[destId][destDeviceId] = "signed_curve25519"
 		}
 	}
+	b.lock.Unlock()
 
 	claimParams := end_to_end_encryption.NewClaimKeysParamsWithContext(c)
 	claimParams.SetQuery(&models.ClaimKeysParamsBody{
@@ -367,28 +452,52 @@ func (b *Bot) ClaimRoomMemberKeys(c context.Context, room_id string) (*models.Cl
 
 	claim, err := b.client.EndToEndEncryption.ClaimKeys(claimParams, b)
 	if err != nil {
-		return nil, deviceKeys, fmt.Errorf("Error claiming keys: %s", err)
+		return nil, fmt.Errorf("Error claiming keys: %w", err)
 	}
 
-	for _, destId := range members {
-		for destDeviceId := range deviceKeys[destId] {
-			b.shookDevices[fmt.Sprintf("%s:%s", room_id, destDeviceId)] = true
-		}
-	}
-
-	return claim.Payload, deviceKeys, nil
+	return claim.Payload, nil
 }
 
 // Initialize an outbound group session for a room and send the session key to every
-// member of the channel so that we can send encrypted events.
+// member of the channel so that we can send encrypted events. The session is rotated
+// first if the room's rotation policy or membership requires it.
 func (b *Bot) HandshakeRoom(c context.Context, room_id string) error {
-	oneTimeKeys, deviceKeys, err := b.ClaimRoomMemberKeys(c, room_id)
+	lock := b.roomLock(room_id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.handshakeRoom(c, room_id)
+}
+
+// Share the room's group session with new devices, the room lock must be held.
+func (b *Bot) handshakeRoom(c context.Context, room_id string) error {
+	members, deviceKeys, err := b.queryRoomDeviceKeys(c, room_id)
+	if err != nil {
+		return err
+	}
+
+	if err := b.rotateGroupSessionIfNeeded(c, room_id, members, deviceKeys); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	groupSession, err := b.groupSession(room_id)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	sessionId, sessionKey := groupSession.GetSessionID(), groupSession.GetSessionKey()
+	b.lock.Unlock()
+
+	oneTimeKeys, err := b.claimRoomDeviceKeys(c, room_id, members, deviceKeys)
 	if err != nil {
 		return err
 	}
 
 	newSessions := []libolm.UserSession{}
 
+	b.lock.Lock()
+
 	for destId, destDevices := range oneTimeKeys.OneTimeKeys {
 		for destDeviceId, keys := range destDevices {
 			for _, keyData := range keys {
@@ -398,6 +507,8 @@ func (b *Bot) HandshakeRoom(c context.Context, room_id string) error {
 
 				session := libolm.CreateOutboundSession(b.Olm.GetAccount(), destKey, destOneTimeKey)
 
+				b.olmSessions[destKey] = append(b.olmSessions[destKey], session)
+
 				newSessions = append(newSessions, libolm.UserSession{
 					Session:    session,
 					UserId:     destId,
@@ -413,26 +524,68 @@ func (b *Bot) HandshakeRoom(c context.Context, room_id string) error {
 			}
 		}
 	}
+	b.lock.Unlock()
 
 	if len(newSessions) == 0 {
 		return nil
 	}
 
-	return b.SendToDeviceEncrypted(c, newSessions, map[string]interface{}{
+	err = b.SendToDeviceEncrypted(c, newSessions, map[string]interface{}{
 		"algorithm":   "m.megolm.v1.aes-sha2",
 		"room_id":     room_id,
-		"session_id":  b.groupSession(room_id).GetSessionID(),
-		"session_key": b.groupSession(room_id).GetSessionKey(),
+		"session_id":  sessionId,
+		"session_key": sessionKey,
 	})
+	if err != nil {
+		return err
+	}
+
+	// Devices that did not return a one-time key are tried again with the next message.
+	b.lock.Lock()
+	if b.shookDevices[room_id] == nil {
+		b.shookDevices[room_id] = map[string]bool{}
+	}
+	for _, session := range newSessions {
+		b.shookDevices[room_id][deviceKey(session.UserId, session.DeviceId)] = true
+	}
+	b.lock.Unlock()
+
+	return b.saveCryptoState()
 }
 
-func (b *Bot) groupSession(channel string) libolm.GroupSession {
-	if _, ok := b.groupSessions[channel]; ! ok {
-		b.groupSessions[channel] = libolm.CreateOutboundGroupSession()
+// Identifies a device in the set of devices a room key has been shared with.
+func deviceKey(userId, deviceId string) string {
+	return fmt.Sprintf("%s:%s", userId, deviceId)
+}
+
+// Get the outbound group session for a room, creating it if it does not exist. b.lock
+// must be held.
+func (b *Bot) groupSession(channel string) (*megolm.OutboundSession, error) {
+	if session, ok := b.groupSessions[channel]; ok {
+		return session, nil
+	}
+
+	session, err := megolm.NewOutboundSession()
+	if err != nil {
+		return nil, fmt.Errorf("Could not create group session: %s", err)
+	}
+
+	b.groupSessions[channel] = session
+	// A new session has not been shared with anyone yet.
+	delete(b.shookDevices, channel)
+
+	// Keep an inbound copy of our own session so that we can decrypt our own
+	// messages when they come back over sync.
+	inbound, err := megolm.NewInboundSession(session.GetSessionKey())
+	if err != nil {
+		return nil, err
 	}
+	identityKeys := b.Olm.GetIdentityKeys()
+	b.addInboundGroupSession(channel, identityKeys.Curve25519, identityKeys.Ed25519, inbound)
 
-	return b.groupSessions[channel]
+	return session, nil
 }
+
 // Craft an encrypted event payload that can be sent to the server as an event.
 func (b *Bot) EncryptedEvent(c context.Context, session libolm.Encrypter, event interface{}) (map[string]string, error) {
 	contentEncoded, err := json.Marshal(event)
@@ -472,7 +625,7 @@ func (b *Bot) SendEvent(c context.Context, channel string, eventType string, pay
 
 	_, err = b.client.RoomParticipation.SendMessage(params, b)
 	if err != nil {
-		return fmt.Errorf("Could not send message: %s", err)
+		return fmt.Errorf("Could not send message: %w", err)
 	}
 
 	return nil
@@ -480,7 +633,13 @@ func (b *Bot) SendEvent(c context.Context, channel string, eventType string, pay
 
 // Send an encrypted event to a channel.
 func (b *Bot) SendEncryptedEvent(c context.Context, channel string, eventType string, message interface{}) error {
-	if err := b.HandshakeRoom(c, channel); err != nil {
+	// Hold the room lock until the event is sent so that the server receives the room's
+	// events in the order of their message indexes.
+	lock := b.roomLock(channel)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := b.handshakeRoom(c, channel); err != nil {
 		return err
 	}
 
@@ -490,11 +649,31 @@ func (b *Bot) SendEncryptedEvent(c context.Context, channel string, eventType st
 		"room_id": channel,
 	}
 
-	encrypted, err := b.EncryptedEvent(c, b.groupSession(channel), payload)
+	b.lock.Lock()
+	groupSession, err := b.groupSession(channel)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+
+	encrypted, err := b.EncryptedEvent(c, groupSession, payload)
+	b.lock.Unlock()
 	if err != nil {
 		return fmt.Errorf("Could not encrypt event: %s", err)
 	}
 
+	// The ratchet has advanced, persist it before sending so that a restart can never
+	// reuse a message index.
+	if err := b.saveCryptoState(); err != nil {
+		return err
+	}
+
+	// Back up a new session before using it so that the message can always be
+	// decrypted again. A failed backup is retried with the next room key, like in sync.
+	if err := b.BackupRoomKeys(c); err != nil {
+		b.syncError(err)
+	}
+
 	stats.RecordWithTags(c, []tag.Mutator{
 		tag.Insert(eventTypeTag, eventType),
 		tag.Insert(channelTag, channel),
@@ -505,42 +684,58 @@ func (b *Bot) SendEncryptedEvent(c context.Context, channel string, eventType st
 
 // Send an unencrypted message to a channel.
 func (b *Bot) Send(c context.Context, channel, message string) error {
-	err := b.JoinRoom(c, channel)
+	unformatted, err := html2text.FromString(message, html2text.Options{})
 	if err != nil {
 		return err
 	}
 
+	return b.sendJoined(c, channel, func() error {
+		return b.SendEvent(c, channel, "m.room.message", map[string]string{
+			"msgtype":        "m.text",
+			"formatted_body": message,
+			"format":         "org.matrix.custom.html",
+			"body":           unformatted,
+		})
+	})
+}
+
+// Send an encrypted message to a channel.
+func (b *Bot) SendEncrypted(c context.Context, channel, message string) error {
 	unformatted, err := html2text.FromString(message, html2text.Options{})
 	if err != nil {
 		return err
 	}
 
-	return b.SendEvent(c, channel, "m.room.message", map[string]string{
-		"msgtype":        "m.text",
-		"formatted_body": message,
-		"format":         "org.matrix.custom.html",
-		"body":           unformatted,
+	return b.sendJoined(c, channel, func() error {
+		return b.SendEncryptedEvent(c, channel, "m.room.message", map[string]string{
+			"body":           unformatted,
+			"formatted_body": message,
+			"msgtype":        "m.text",
+			"format":         "org.matrix.custom.html",
+		})
 	})
 }
 
-// Send an encrypted message to a channel.
-func (b *Bot) SendEncrypted(c context.Context, channel, message string) error {
-	err := b.JoinRoom(c, channel)
-	if err != nil {
+// Join a room and send to it. Bots that do not sync never notice being kicked, so if
+// the server refuses the send the room is dropped from the cache of joined rooms and
+// the join and send are retried once.
+func (b *Bot) sendJoined(c context.Context, channel string, send func() error) error {
+	if err := b.JoinRoom(c, channel); err != nil {
 		return err
 	}
 
-	unformatted, err := html2text.FromString(message, html2text.Options{})
-	if err != nil {
+	err := send()
+	if ErrCode(err) != "M_FORBIDDEN" {
 		return err
 	}
 
-	return b.SendEncryptedEvent(c, channel, "m.room.message", map[string]string{
-		"body":           unformatted,
-		"formatted_body": message,
-		"msgtype":        "m.text",
-		"format":         "org.matrix.custom.html",
-	})
+	b.leftRoom(channel)
+
+	if err := b.JoinRoom(c, channel); err != nil {
+		return err
+	}
+
+	return send()
 }
 
 // Craft an encrypted event that can be sent directly to a device.
@@ -583,14 +778,13 @@ func (b *Bot) EncryptedDirectEvent(c context.Context, session libolm.UserSession
 
 // Send a message to a specific device. Primarily used for sending room_key messages.
 func (b *Bot) SendToDeviceEncrypted(c context.Context, sessions []libolm.UserSession, event interface{}) error {
-	params := send_to_device_messaging.NewSendToDeviceParamsWithContext(c)
-	params.SetEventType("m.room.encrypted")
-
 	messages := map[string]map[string]interface{}{}
 
+	b.lock.Lock()
 	for _, session := range sessions {
 		encrypted, err := b.EncryptedDirectEvent(c, session, event)
 		if err != nil {
+			b.lock.Unlock()
 			return fmt.Errorf("Could not encrypt event: %s", err)
 		}
 		if messages[session.UserId] == nil {
@@ -599,7 +793,27 @@ func (b *Bot) SendToDeviceEncrypted(c context.Context, sessions []libolm.UserSes
 
 		messages[session.UserId][session.DeviceId] = encrypted
 	}
+	b.lock.Unlock()
+
+	return b.sendToDevice(c, "m.room.encrypted", messages)
+}
 
+// Send an unencrypted event directly to a device.
+func (b *Bot) SendToDevice(c context.Context, userId, deviceId, eventType string, content interface{}) error {
+	stats.RecordWithTags(c, []tag.Mutator{
+		tag.Insert(eventTypeTag, eventType),
+		tag.Insert(destIdTag, userId),
+		tag.Insert(destDeviceIdTag, deviceId),
+	}, directEventCount.M(1))
+
+	return b.sendToDevice(c, eventType, map[string]map[string]interface{}{
+		userId: {deviceId: content},
+	})
+}
+
+func (b *Bot) sendToDevice(c context.Context, eventType string, messages map[string]map[string]interface{}) error {
+	params := send_to_device_messaging.NewSendToDeviceParamsWithContext(c)
+	params.SetEventType(eventType)
 	params.SetBody(&models.SendToDeviceParamsBody{
 		Messages: messages,
 	})
@@ -613,7 +827,7 @@ func (b *Bot) SendToDeviceEncrypted(c context.Context, sessions []libolm.UserSes
 
 	_, err = b.client.SendToDeviceMessaging.SendToDevice(params, b)
 	if err != nil {
-		return fmt.Errorf("Could not send message: %s", err)
+		return fmt.Errorf("Could not send message: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,155 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/room_membership"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// Invite a user to a room.
+func (b *Bot) InviteUser(c context.Context, room_id, userId string) error {
+	// The generated InviteUser has a stray space at the end of its path.
+	body := map[string]string{
+		"user_id": userId,
+	}
+
+	if err := b.doJSON(c, "POST", "/rooms/"+url.PathEscape(room_id)+"/invite", body, nil); err != nil {
+		return fmt.Errorf("Could not invite %s to %s: %w", userId, room_id, err)
+	}
+
+	return nil
+}
+
+// Leave a room, or reject an invite to it. The room's outbound Megolm session is
+// discarded so that a new one is shared if the bot joins it again.
+func (b *Bot) LeaveRoom(c context.Context, room_id string) error {
+	params := room_membership.NewLeaveRoomParamsWithContext(c)
+	params.SetRoomID(room_id)
+
+	if _, err := b.client.RoomMembership.LeaveRoom(params, b); err != nil {
+		return fmt.Errorf("Could not leave %s: %w", room_id, err)
+	}
+
+	b.leftRoom(room_id)
+	return b.saveCryptoState()
+}
+
+// List the rooms the bot is in, refreshing its cache of joined rooms.
+func (b *Bot) JoinedRooms(c context.Context) ([]string, error) {
+	result, err := b.client.RoomMembership.GetJoinedRooms(room_membership.NewGetJoinedRoomsParamsWithContext(c), b)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list joined rooms: %w", err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.joinedRooms = map[string]bool{}
+	for _, room_id := range result.Payload.JoinedRooms {
+		b.joinedRooms[room_id] = true
+	}
+	b.joinedRoomsLoaded = true
+
+	return result.Payload.JoinedRooms, nil
+}
+
+// Whether the bot is in a room, as far as its cache of joined rooms knows.
+func (b *Bot) IsJoined(room_id string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.joinedRooms[room_id]
+}
+
+// Keep the cache of joined rooms current with the membership changes seen by sync.
+func (b *Bot) handleRoomMemberships(joined, left []string) {
+	b.lock.Lock()
+	for _, room_id := range joined {
+		b.joinedRooms[room_id] = true
+	}
+	b.lock.Unlock()
+
+	for _, room_id := range left {
+		b.leftRoom(room_id)
+	}
+}
+
+// Drop what is cached about a room the bot left or was removed from, including its
+// outbound group session so that a new one is shared if the bot joins it again.
+func (b *Bot) leftRoom(room_id string) {
+	lock := b.roomLock(room_id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.joinedRooms, room_id)
+	delete(b.rotationPolicies, room_id)
+	b.rotateGroupSession(room_id)
+}
+
+// Forget a room that the bot has left, so that it no longer shows up in its history.
+func (b *Bot) ForgetRoom(c context.Context, room_id string) error {
+	params := room_membership.NewForgetRoomParamsWithContext(c)
+	params.SetRoomID(room_id)
+
+	if _, err := b.client.RoomMembership.ForgetRoom(params, b); err != nil {
+		return fmt.Errorf("Could not forget %s: %w", room_id, err)
+	}
+
+	return nil
+}
+
+// Kick a user out of a room, reason is optional. The room's outbound Megolm session is
+// rotated so that the user cannot read messages sent after they left.
+func (b *Bot) KickUser(c context.Context, room_id, userId, reason string) error {
+	params := room_membership.NewKickParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetBody(&models.KickParamsBody{
+		UserID: &userId,
+		Reason: reason,
+	})
+
+	if _, err := b.client.RoomMembership.Kick(params, b); err != nil {
+		return fmt.Errorf("Could not kick %s from %s: %w", userId, room_id, err)
+	}
+
+	b.RotateGroupSession(room_id)
+	return nil
+}
+
+// Ban a user from a room, reason is optional. The room's outbound Megolm session is
+// rotated so that the user cannot read messages sent after they left.
+func (b *Bot) BanUser(c context.Context, room_id, userId, reason string) error {
+	params := room_membership.NewBanParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetBody(&models.BanParamsBody{
+		UserID: &userId,
+		Reason: reason,
+	})
+
+	if _, err := b.client.RoomMembership.Ban(params, b); err != nil {
+		return fmt.Errorf("Could not ban %s from %s: %w", userId, room_id, err)
+	}
+
+	b.RotateGroupSession(room_id)
+	return nil
+}
+
+// Lift a user's ban from a room. They need to be invited or join again to get back in.
+func (b *Bot) UnbanUser(c context.Context, room_id, userId string) error {
+	params := room_membership.NewUnbanParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetBody(&models.UnbanParamsBody{
+		UserID: &userId,
+	})
+
+	if _, err := b.client.RoomMembership.Unban(params, b); err != nil {
+		return fmt.Errorf("Could not unban %s from %s: %w", userId, room_id, err)
+	}
+
+	return nil
+}
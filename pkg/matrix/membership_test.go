@@ -0,0 +1,168 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembership(t *testing.T) {
+	requests := map[string]map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		body := map[string]interface{}{}
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+		requests[r.URL.Path] = body
+
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	room_id := "!room:example.org"
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+
+	bot.joinedRooms[room_id] = true
+	bot.groupSessions[room_id] = outbound
+	bot.rotationPolicies[room_id] = RotationPolicy{Messages: 10}
+
+	assert.Nil(t, bot.InviteUser(context.TODO(), room_id, "@alice:example.org"))
+	assert.Nil(t, bot.KickUser(context.TODO(), room_id, "@mallory:example.org", "spam"))
+	assert.Nil(t, bot.BanUser(context.TODO(), room_id, "@mallory:example.org", ""))
+	assert.Nil(t, bot.UnbanUser(context.TODO(), room_id, "@mallory:example.org"))
+
+	prefix := "/_matrix/client/unstable/rooms/" + room_id
+	assert.Equal(t, map[string]interface{}{"user_id": "@alice:example.org"}, requests[prefix+"/invite"])
+	assert.Equal(t, map[string]interface{}{"user_id": "@mallory:example.org", "reason": "spam"}, requests[prefix+"/kick"])
+	assert.Equal(t, map[string]interface{}{"user_id": "@mallory:example.org"}, requests[prefix+"/ban"])
+	assert.Equal(t, map[string]interface{}{"user_id": "@mallory:example.org"}, requests[prefix+"/unban"])
+
+	// Kicked users must not be able to read later messages.
+	_, ok := bot.groupSessions[room_id]
+	assert.False(t, ok)
+
+	bot.groupSessions[room_id] = outbound
+
+	assert.Nil(t, bot.LeaveRoom(context.TODO(), room_id))
+	assert.Nil(t, bot.ForgetRoom(context.TODO(), room_id))
+	assert.NotNil(t, requests[prefix+"/leave"])
+	assert.NotNil(t, requests[prefix+"/forget"])
+
+	// Leaving drops everything cached about the room.
+	_, ok = bot.joinedRooms[room_id]
+	assert.False(t, ok)
+	_, ok = bot.groupSessions[room_id]
+	assert.False(t, ok)
+	_, ok = bot.rotationPolicies[room_id]
+	assert.False(t, ok)
+}
+
+func TestJoinedRoomCache(t *testing.T) {
+	joins := []string{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/joined_rooms":
+			fmt.Fprint(w, `{"joined_rooms": ["!joined:example.org"]}`)
+		case "/_matrix/client/unstable/sync":
+			fmt.Fprint(w, `{"next_batch": "s2", "rooms": {
+				"join": {"!invited:example.org": {}},
+				"leave": {"!joined:example.org": {
+					"timeline": {"events": [{"type": "m.room.member", "state_key": "@bot:example.org", "sender": "@alice:example.org", "content": {"membership": "leave"}}]}
+				}}
+			}}`)
+		default:
+			joins = append(joins, r.URL.Path)
+			fmt.Fprint(w, `{"room_id": "!room:example.org"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	// Rooms the bot is already in are not joined again.
+	assert.Nil(t, bot.JoinRoom(context.TODO(), "!joined:example.org"))
+	assert.Nil(t, bot.JoinRoom(context.TODO(), "!other:example.org"))
+	assert.Nil(t, bot.JoinRoom(context.TODO(), "!other:example.org"))
+	assert.Equal(t, []string{"/_matrix/client/unstable/rooms/!other:example.org/join"}, joins)
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	bot.groupSessions["!joined:example.org"] = outbound
+
+	// Sync notices that the bot was kicked and that it joined a room elsewhere.
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+	assert.False(t, bot.IsJoined("!joined:example.org"))
+	assert.True(t, bot.IsJoined("!invited:example.org"))
+	_, ok := bot.groupSessions["!joined:example.org"]
+	assert.False(t, ok)
+
+	assert.Nil(t, bot.JoinRoom(context.TODO(), "!invited:example.org"))
+	assert.Nil(t, bot.JoinRoom(context.TODO(), "!joined:example.org"))
+	assert.Equal(t, []string{
+		"/_matrix/client/unstable/rooms/!other:example.org/join",
+		"/_matrix/client/unstable/rooms/!joined:example.org/join",
+	}, joins)
+}
+
+func TestSendRejoinsAfterKick(t *testing.T) {
+	joins := 0
+	sends := 0
+	joined := true
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/joined_rooms":
+			fmt.Fprint(w, `{"joined_rooms": ["!room:example.org"]}`)
+		case "/_matrix/client/unstable/rooms/!room:example.org/join":
+			joins++
+			joined = true
+			fmt.Fprint(w, `{"room_id": "!room:example.org"}`)
+		default:
+			sends++
+			if !joined {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"errcode": "M_FORBIDDEN", "error": "You are not in this room"}`)
+				return
+			}
+			fmt.Fprint(w, `{"event_id": "$event"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	assert.Nil(t, bot.Send(context.TODO(), "!room:example.org", "hello"))
+	assert.Equal(t, 0, joins)
+
+	// The bot is kicked without syncing, so its cache still says it is in the room.
+	joined = false
+	assert.Nil(t, bot.Send(context.TODO(), "!room:example.org", "hello again"))
+	assert.Equal(t, 1, joins)
+	assert.Equal(t, 3, sends)
+	assert.True(t, bot.IsJoined("!room:example.org"))
+
+	// A room the bot cannot get back into is not retried forever.
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errcode": "M_FORBIDDEN", "error": "You are banned from this room"}`)
+	})
+	assert.Equal(t, "M_FORBIDDEN", ErrCode(bot.Send(context.TODO(), "!room:example.org", "hello")))
+}
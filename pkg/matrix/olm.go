@@ -0,0 +1,152 @@
+package matrix
+
+// #cgo LDFLAGS: -lolm
+// #include <stdlib.h>
+// #include <olm/olm.h>
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+
+	libolm "github.com/justinbarrick/libolm-go"
+)
+
+// An Olm account in C memory, for the operations that libolm-go does not wrap. libolm-go
+// always pickles its accounts with defaultPickleKey, so accounts are passed between the
+// two as pickles.
+type cAccount struct {
+	buffer  unsafe.Pointer
+	account *C.OlmAccount
+}
+
+func newCAccount() *cAccount {
+	buffer := C.malloc(C.olm_account_size())
+	return &cAccount{buffer: buffer, account: C.olm_account(buffer)}
+}
+
+func (a *cAccount) free() {
+	C.olm_clear_account(a.account)
+	C.free(a.buffer)
+}
+
+func (a *cAccount) lastError() string {
+	return C.GoString(C.olm_account_last_error(a.account))
+}
+
+func (a *cAccount) unpickle(key, pickle string) error {
+	cKey := C.CBytes([]byte(key))
+	defer C.free(cKey)
+	pickled := C.CBytes([]byte(pickle))
+	defer C.free(pickled)
+
+	if C.olm_unpickle_account(a.account, cKey, C.size_t(len(key)), pickled, C.size_t(len(pickle))) == C.olm_error() {
+		return fmt.Errorf("Could not unpickle Olm account: %s", a.lastError())
+	}
+
+	return nil
+}
+
+func (a *cAccount) pickle(key string) (string, error) {
+	cKey := C.CBytes([]byte(key))
+	defer C.free(cKey)
+
+	length := C.olm_pickle_account_length(a.account)
+	pickled := C.malloc(length)
+	defer C.free(pickled)
+
+	if C.olm_pickle_account(a.account, cKey, C.size_t(len(key)), pickled, length) == C.olm_error() {
+		return "", fmt.Errorf("Could not pickle Olm account: %s", a.lastError())
+	}
+
+	return C.GoStringN((*C.char)(pickled), C.int(length)), nil
+}
+
+// Copy a libolm-go account into C memory.
+func loadCAccount(account *libolm.Matrix) (*cAccount, error) {
+	olmAccount := newCAccount()
+	if err := olmAccount.unpickle(defaultPickleKey, account.GetAccount().Pickle(defaultPickleKey)); err != nil {
+		olmAccount.free()
+		return nil, err
+	}
+
+	return olmAccount, nil
+}
+
+// Copy an account in C memory back into a libolm-go account.
+func (a *cAccount) store(account *libolm.Matrix) error {
+	pickle, err := a.pickle(defaultPickleKey)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(pickle)
+	if err != nil {
+		return err
+	}
+
+	return account.UnmarshalJSON(data)
+}
+
+// Pickle an Olm account with key.
+func pickleAccount(account *libolm.Matrix, key string) (string, error) {
+	olmAccount, err := loadCAccount(account)
+	if err != nil {
+		return "", err
+	}
+	defer olmAccount.free()
+
+	return olmAccount.pickle(key)
+}
+
+// Unpickle an Olm account pickled by pickleAccount with key. Unlike libolm-go, a wrong
+// key is an error rather than an empty account.
+func unpickleAccount(pickle, key string) (*libolm.Matrix, error) {
+	olmAccount := newCAccount()
+	defer olmAccount.free()
+
+	if err := olmAccount.unpickle(key, pickle); err != nil {
+		return nil, err
+	}
+
+	account := &libolm.Matrix{}
+	if err := olmAccount.store(account); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// Remove the one-time key that an inbound session was created with from the account, so
+// that the pre-key message cannot be used to create the session again. libolm-go does not
+// wrap olm_remove_one_time_keys, so the account and session are passed through pickles.
+func removeOneTimeKeys(account *libolm.Matrix, session libolm.Session) error {
+	olmAccount, err := loadCAccount(account)
+	if err != nil {
+		return err
+	}
+	defer olmAccount.free()
+
+	key := C.CBytes([]byte(defaultPickleKey))
+	defer C.free(key)
+
+	sessionBuffer := C.malloc(C.olm_session_size())
+	defer C.free(sessionBuffer)
+	olmSession := C.olm_session(sessionBuffer)
+	defer C.olm_clear_session(olmSession)
+
+	sessionPickle := session.Pickle(defaultPickleKey)
+	pickledSession := C.CBytes([]byte(sessionPickle))
+	defer C.free(pickledSession)
+
+	if C.olm_unpickle_session(olmSession, key, C.size_t(len(defaultPickleKey)), pickledSession, C.size_t(len(sessionPickle))) == C.olm_error() {
+		return fmt.Errorf("Could not unpickle Olm session: %s", C.GoString(C.olm_session_last_error(olmSession)))
+	}
+
+	if C.olm_remove_one_time_keys(olmAccount.account, olmSession) == C.olm_error() {
+		return fmt.Errorf("Could not remove one-time key: %s", olmAccount.lastError())
+	}
+
+	return olmAccount.store(account)
+}
@@ -0,0 +1,106 @@
+package matrix
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Recovery keys start with these bytes so that they can be told apart from other
+// base58 strings.
+var recoveryKeyPrefix = []byte{0x8b, 0x01}
+
+func base58Encode(data []byte) string {
+	number := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	modulo := new(big.Int)
+
+	encoded := []byte{}
+	for number.Sign() > 0 {
+		number.DivMod(number, radix, modulo)
+		encoded = append(encoded, base58Alphabet[modulo.Int64()])
+	}
+
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return string(encoded)
+}
+
+func base58Decode(encoded string) ([]byte, error) {
+	number := new(big.Int)
+	radix := big.NewInt(58)
+
+	for _, c := range encoded {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("Invalid base58 character: %c", c)
+		}
+		number.Mul(number, radix)
+		number.Add(number, big.NewInt(int64(digit)))
+	}
+
+	zeros := 0
+	for zeros < len(encoded) && encoded[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	return append(make([]byte, zeros), number.Bytes()...), nil
+}
+
+// Encode a backup private key as a recovery key that users can write down.
+func encodeRecoveryKey(privateKey []byte) string {
+	data := append(append([]byte{}, recoveryKeyPrefix...), privateKey...)
+
+	parity := byte(0)
+	for _, b := range data {
+		parity ^= b
+	}
+	data = append(data, parity)
+
+	encoded := base58Encode(data)
+
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		end := i + 4
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		groups = append(groups, encoded[i:end])
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// Decode a recovery key into the backup private key, checking its prefix and parity.
+func decodeRecoveryKey(recoveryKey string) ([]byte, error) {
+	data, err := base58Decode(strings.Join(strings.Fields(recoveryKey), ""))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode recovery key: %s", err)
+	}
+
+	if len(data) != len(recoveryKeyPrefix)+32+1 || data[0] != recoveryKeyPrefix[0] || data[1] != recoveryKeyPrefix[1] {
+		return nil, fmt.Errorf("Invalid recovery key")
+	}
+
+	parity := byte(0)
+	for _, b := range data {
+		parity ^= b
+	}
+
+	if parity != 0 {
+		return nil, fmt.Errorf("Invalid recovery key parity")
+	}
+
+	return data[len(recoveryKeyPrefix) : len(data)-1], nil
+}
@@ -0,0 +1,85 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+)
+
+// Decodes a JSON response into result. Error responses are turned into an Error by the
+// bot's transport.
+type jsonReader struct {
+	result interface{}
+}
+
+func (j jsonReader) ReadResponse(response runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+	if response.Code() < 200 || response.Code() > 299 {
+		return nil, runtime.NewAPIError("unknown error", response, response.Code())
+	}
+
+	if j.result == nil {
+		return nil, nil
+	}
+
+	return j.result, json.NewDecoder(response.Body()).Decode(j.result)
+}
+
+// Call an endpoint that the generated client does not cover, such as the ones added to
+// the spec after it was generated. path may include a query string. body and result are
+// encoded and decoded as JSON and either may be nil.
+func (b *Bot) doJSON(c context.Context, method, path string, body, result interface{}) error {
+	return b.submitJSON(c, b, method, path, body, result)
+}
+
+// Like doJSON, for endpoints such as /login that are called without an access token.
+func (b *Bot) doUnauthenticatedJSON(c context.Context, method, path string, body, result interface{}) error {
+	return b.submitJSON(c, nil, method, path, body, result)
+}
+
+func (b *Bot) submitJSON(c context.Context, auth runtime.ClientAuthInfoWriter, method, path string, body, result interface{}) error {
+	path, rawQuery := splitQuery(path)
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("Could not parse query: %s", err)
+	}
+
+	params := runtime.ClientRequestWriterFunc(func(request runtime.ClientRequest, registry strfmt.Registry) error {
+		for key, values := range query {
+			if err := request.SetQueryParam(key, values...); err != nil {
+				return err
+			}
+		}
+
+		if body != nil {
+			return request.SetBodyParam(body)
+		}
+		return nil
+	})
+
+	_, err = b.client.Transport.Submit(&runtime.ClientOperation{
+		ID:                 path,
+		Method:             method,
+		PathPattern:        "/_matrix/client/unstable" + path,
+		ProducesMediaTypes: []string{"application/json"},
+		ConsumesMediaTypes: []string{"application/json"},
+		Schemes:            []string{"https"},
+		Params:             params,
+		Reader:             jsonReader{result},
+		AuthInfo:           auth,
+		Context:            c,
+	})
+
+	return err
+}
+
+func splitQuery(path string) (string, string) {
+	if i := strings.Index(path, "?"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
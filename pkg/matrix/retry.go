@@ -0,0 +1,174 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+const (
+	defaultMaxRetries = 5
+	retryMinBackoff   = 500 * time.Millisecond
+	retryMaxBackoff   = 30 * time.Second
+)
+
+var retryCount = stats.Int64("slack2matrix/matrix_request_retries", "number of requests to matrix servers that were retried", stats.UnitDimensionless)
+
+// An http.RoundTripper that retries requests the homeserver rate limited with
+// M_LIMIT_EXCEEDED, waiting as long as the server asks. If the server asks for longer
+// than MaxBackoff the rate limited response is returned instead. Idempotent requests
+// are also retried with jittered exponential backoff when they fail with a transient
+// server or network error. Requests are replayed unchanged, so a retried PUT to /send
+// keeps its transaction ID and the server never stores the message twice.
+type RetryTransport struct {
+	Transport http.RoundTripper
+	// How many times a request is retried before its last response is returned.
+	MaxRetries int
+	// Bounds for the backoff between retries when the server does not say how long to
+	// wait. MaxBackoff also bounds how long a rate limited request waits.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Wrap transport with the default retry settings.
+func NewRetryTransport(transport http.RoundTripper) *RetryTransport {
+	return &RetryTransport{
+		Transport:  transport,
+		MaxRetries: defaultMaxRetries,
+		MinBackoff: retryMinBackoff,
+		MaxBackoff: retryMaxBackoff,
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Keep the body so that it can be sent again.
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req.Clone(req.Context())
+		if req.Body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.Transport.RoundTrip(attemptReq)
+
+		wait, retry := t.retryDelay(req, resp, err, attempt)
+		if !retry || attempt >= t.MaxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		stats.Record(req.Context(), retryCount.M(1))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Decide whether a request should be retried and how long to wait first.
+func (t *RetryTransport) retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if err != nil {
+		return t.backoff(attempt), isIdempotent(req.Method) && req.Context().Err() == nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// The server did not handle a rate limited request, so it is safe to retry
+		// whatever its method.
+		if wait := retryAfter(resp); wait > t.MaxBackoff {
+			return 0, false
+		} else if wait > 0 {
+			return wait, true
+		}
+		return t.backoff(attempt), true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return t.backoff(attempt), isIdempotent(req.Method)
+	}
+
+	return 0, false
+}
+
+// Exponential backoff with jitter so that clients that failed together do not retry
+// together.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	backoff := t.MinBackoff
+	for i := 0; i < attempt && backoff < t.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > t.MaxBackoff {
+		backoff = t.MaxBackoff
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Read how long a rate limited response asks us to wait, from retry_after_ms in the
+// body or the Retry-After header. The body is put back so that it can still be read.
+func retryAfter(resp *http.Response) time.Duration {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+
+	body := map[string]interface{}{}
+	if json.Unmarshal(data, &body) == nil {
+		if ms, ok := contentNumber(body, "retry_after_ms"); ok && ms > 0 {
+			return saturatingDuration(ms, time.Millisecond)
+		}
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return saturatingDuration(float64(seconds), time.Second)
+	}
+
+	return 0
+}
+
+// Convert a count of units to a duration, saturating rather than overflowing.
+func saturatingDuration(count float64, unit time.Duration) time.Duration {
+	if count >= float64(math.MaxInt64/int64(unit)) {
+		return math.MaxInt64
+	}
+	return time.Duration(count * float64(unit))
+}
+
+// Requests that have the same effect no matter how often they are sent. Matrix PUT
+// requests carry a transaction ID for this reason.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
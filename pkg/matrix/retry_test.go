@@ -0,0 +1,114 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetryTestBot(t *testing.T, server *httptest.Server) *Bot {
+	bot := newTestBot(t, server)
+
+	transport := NewRetryTransport(server.Client().Transport)
+	transport.MinBackoff = time.Millisecond
+	transport.MaxBackoff = 50 * time.Millisecond
+	bot.httpRuntime.Transport = transport
+
+	return bot
+}
+
+func TestRetryRateLimitedSend(t *testing.T) {
+	paths := []string{}
+	bodies := []string{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		body, _ := ioutil.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+
+		if len(paths) < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 20}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"event_id": "$1"}`)
+	}))
+	defer server.Close()
+
+	bot := newRetryTestBot(t, server)
+
+	start := time.Now()
+	assert.Nil(t, bot.SendEvent(context.TODO(), "!room:example.org", "m.room.message", map[string]string{"body": "hi"}))
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	// Every attempt used the same transaction ID and body.
+	assert.Equal(t, 3, len(paths))
+	assert.Equal(t, paths[0], paths[1])
+	assert.Equal(t, paths[0], paths[2])
+	assert.Equal(t, bodies[0], bodies[2])
+	assert.Contains(t, bodies[0], `"body":"hi"`)
+}
+
+func TestRetryRateLimitTooLong(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1e300}`)
+	}))
+	defer server.Close()
+
+	bot := newRetryTestBot(t, server)
+
+	// The rate limit is returned instead of waiting longer than the maximum backoff.
+	err := bot.SendEvent(context.TODO(), "!room:example.org", "m.room.message", map[string]string{"body": "hi"})
+	assert.Equal(t, "M_LIMIT_EXCEEDED", ErrCode(err))
+	assert.Equal(t, 1, requests)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	requests := map[string]int{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		requests[r.Method]++
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	bot := newRetryTestBot(t, server)
+
+	// Idempotent requests are retried until they run out of retries.
+	assert.NotNil(t, bot.doJSON(context.TODO(), "GET", "/room_keys/version", nil, nil))
+	assert.Equal(t, defaultMaxRetries+1, requests["GET"])
+
+	// Other requests may already have had an effect.
+	assert.NotNil(t, bot.doJSON(context.TODO(), "POST", "/room_keys/version", map[string]string{}, nil))
+	assert.Equal(t, 1, requests["POST"])
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{
+		Header: http.Header{"Retry-After": []string{"2"}},
+		Body:   ioutil.NopCloser(strings.NewReader(`{"errcode": "M_LIMIT_EXCEEDED"}`)),
+	}
+	assert.Equal(t, 2*time.Second, retryAfter(resp))
+
+	// The body can still be read by the client.
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"errcode": "M_LIMIT_EXCEEDED"}`, string(body))
+}
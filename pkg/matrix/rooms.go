@@ -0,0 +1,285 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/room_creation"
+	"github.com/justinbarrick/go-matrix/pkg/client/room_participation"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// Presets for CreateRoom, which set a new room's join rules, history visibility and
+// guest access.
+const (
+	PresetPrivateChat        = "private_chat"
+	PresetTrustedPrivateChat = "trusted_private_chat"
+	PresetPublicChat         = "public_chat"
+)
+
+// Who can join a room, the join_rule of its m.room.join_rules state.
+const (
+	JoinRulePublic  = "public"
+	JoinRuleInvite  = "invite"
+	JoinRuleKnock   = "knock"
+	JoinRulePrivate = "private"
+)
+
+// A state event to set when a room is created.
+type InitialStateEvent struct {
+	Type     string
+	StateKey string
+	Content  interface{}
+}
+
+// Settings for a new room, see CreateRoom.
+type RoomOptions struct {
+	Name  string
+	Topic string
+	// One of the Preset constants, the server picks one from Public if it is empty.
+	Preset string
+	// Publish the room in the server's room directory.
+	Public bool
+	// The local part of an alias for the room, such as alerts for #alerts:example.com.
+	Alias string
+	// User IDs to invite to the room.
+	Invite []string
+	// Mark the room as a direct chat with the invited users.
+	IsDirect bool
+	// Turn on end-to-end encryption with Megolm.
+	Encrypted bool
+	// Replace the power levels the preset would set. The bot keeps power level 100.
+	PowerLevels *PowerLevels
+	// Other state events to set, such as m.room.history_visibility.
+	InitialState []InitialStateEvent
+}
+
+// The content of a room's m.room.power_levels state.
+type PowerLevels struct {
+	Ban           int            `json:"ban"`
+	Invite        int            `json:"invite"`
+	Kick          int            `json:"kick"`
+	Redact        int            `json:"redact"`
+	StateDefault  int            `json:"state_default"`
+	EventsDefault int            `json:"events_default"`
+	UsersDefault  int            `json:"users_default"`
+	Events        map[string]int `json:"events,omitempty"`
+	Users         map[string]int `json:"users,omitempty"`
+	Notifications map[string]int `json:"notifications,omitempty"`
+}
+
+// The power levels the spec defaults to for any that a room does not set.
+func DefaultPowerLevels() *PowerLevels {
+	return &PowerLevels{
+		Ban:          50,
+		Kick:         50,
+		Redact:       50,
+		StateDefault: 50,
+		Events:       map[string]int{},
+		Users:        map[string]int{},
+	}
+}
+
+// Create a room with the bot as its creator and return its room ID.
+func (b *Bot) CreateRoom(c context.Context, options RoomOptions) (string, error) {
+	body := &models.CreateRoomParamsBody{
+		Name:          options.Name,
+		Topic:         options.Topic,
+		Preset:        options.Preset,
+		RoomAliasName: options.Alias,
+		Invite:        options.Invite,
+		IsDirect:      options.IsDirect,
+		Visibility:    "private",
+	}
+
+	if options.Public {
+		body.Visibility = "public"
+	}
+
+	if options.PowerLevels != nil {
+		powerLevels := *options.PowerLevels
+		powerLevels.Users = map[string]int{b.UserId: 100}
+		for userId, level := range options.PowerLevels.Users {
+			powerLevels.Users[userId] = level
+		}
+		body.PowerLevelContentOverride = powerLevels
+	}
+
+	initialState := options.InitialState
+	if options.Encrypted {
+		initialState = append(initialState, InitialStateEvent{
+			Type:    "m.room.encryption",
+			Content: map[string]interface{}{"algorithm": megolmAlgorithm},
+		})
+	}
+
+	for _, event := range initialState {
+		eventType := event.Type
+		body.InitialState = append(body.InitialState, &models.CreateRoomParamsBodyInitialStateItems{
+			Type:     &eventType,
+			StateKey: event.StateKey,
+			Content:  event.Content,
+		})
+	}
+
+	params := room_creation.NewCreateRoomParamsWithContext(c)
+	params.SetBody(body)
+
+	created, err := b.client.RoomCreation.CreateRoom(params, b)
+	if err != nil {
+		return "", fmt.Errorf("Could not create room: %w", err)
+	}
+
+	room_id := *created.Payload.RoomID
+
+	b.lock.Lock()
+	b.joinedRooms[room_id] = true
+	if options.Encrypted {
+		b.rotationPolicies[room_id] = rotationPolicyFromContent(map[string]interface{}{})
+	}
+	b.lock.Unlock()
+
+	return room_id, nil
+}
+
+// Read the content of a room's state event into content, which is decoded as JSON. A
+// missing event returns an error with the M_NOT_FOUND ErrCode.
+func (b *Bot) RoomState(c context.Context, room_id, eventType, stateKey string, content interface{}) error {
+	params := room_participation.NewGetRoomStateWithKeyParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetEventType(eventType)
+	params.SetStateKey(stateKey)
+
+	state, err := b.client.RoomParticipation.GetRoomStateWithKey(params, b)
+	if err != nil {
+		return fmt.Errorf("Could not get %s state: %w", eventType, err)
+	}
+
+	data, err := json.Marshal(state.Payload)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, content)
+}
+
+// Set a room state event, returning its event ID.
+func (b *Bot) SetRoomState(c context.Context, room_id, eventType, stateKey string, content interface{}) (string, error) {
+	params := room_participation.NewSetRoomStateWithKeyParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetEventType(eventType)
+	params.SetStateKey(stateKey)
+	params.SetBody(content)
+
+	result, err := b.client.RoomParticipation.SetRoomStateWithKey(params, b)
+	if err != nil {
+		return "", fmt.Errorf("Could not set %s state: %w", eventType, err)
+	}
+
+	return result.Payload.EventID, nil
+}
+
+// Read a string field of a state event, empty if the room does not have the event.
+func (b *Bot) roomStateString(c context.Context, room_id, eventType, field string) (string, error) {
+	content := map[string]interface{}{}
+	err := b.RoomState(c, room_id, eventType, "", &content)
+	if ErrCode(err) == "M_NOT_FOUND" {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return contentString(content, field), nil
+}
+
+// Get a room's name, empty if it has none.
+func (b *Bot) RoomName(c context.Context, room_id string) (string, error) {
+	return b.roomStateString(c, room_id, "m.room.name", "name")
+}
+
+// Set a room's name.
+func (b *Bot) SetRoomName(c context.Context, room_id, name string) error {
+	_, err := b.SetRoomState(c, room_id, "m.room.name", "", map[string]string{"name": name})
+	return err
+}
+
+// Get a room's topic, empty if it has none.
+func (b *Bot) RoomTopic(c context.Context, room_id string) (string, error) {
+	return b.roomStateString(c, room_id, "m.room.topic", "topic")
+}
+
+// Set a room's topic.
+func (b *Bot) SetRoomTopic(c context.Context, room_id, topic string) error {
+	_, err := b.SetRoomState(c, room_id, "m.room.topic", "", map[string]string{"topic": topic})
+	return err
+}
+
+// Get a room's join rule, one of the JoinRule constants.
+func (b *Bot) RoomJoinRule(c context.Context, room_id string) (string, error) {
+	return b.roomStateString(c, room_id, "m.room.join_rules", "join_rule")
+}
+
+// Set who can join a room, one of the JoinRule constants.
+func (b *Bot) SetRoomJoinRule(c context.Context, room_id, joinRule string) error {
+	_, err := b.SetRoomState(c, room_id, "m.room.join_rules", "", map[string]string{"join_rule": joinRule})
+	return err
+}
+
+// Get a room's power levels, with the spec's defaults for any that it does not set.
+func (b *Bot) RoomPowerLevels(c context.Context, room_id string) (*PowerLevels, error) {
+	powerLevels := DefaultPowerLevels()
+	if err := b.RoomState(c, room_id, "m.room.power_levels", "", powerLevels); err != nil {
+		return nil, err
+	}
+	return powerLevels, nil
+}
+
+// Replace a room's power levels. Read them with RoomPowerLevels first to change some.
+func (b *Bot) SetRoomPowerLevels(c context.Context, room_id string, powerLevels *PowerLevels) error {
+	_, err := b.SetRoomState(c, room_id, "m.room.power_levels", "", powerLevels)
+	return err
+}
+
+// Get whether a room is encrypted and how often its Megolm sessions are rotated.
+func (b *Bot) RoomEncryption(c context.Context, room_id string) (bool, RotationPolicy, error) {
+	content := map[string]interface{}{}
+	err := b.RoomState(c, room_id, "m.room.encryption", "", &content)
+	if ErrCode(err) == "M_NOT_FOUND" {
+		return false, RotationPolicy{}, nil
+	} else if err != nil {
+		return false, RotationPolicy{}, err
+	}
+
+	return contentString(content, "algorithm") != "", rotationPolicyFromContent(content), nil
+}
+
+// Turn on end-to-end encryption in a room. It cannot be turned off again. Zero fields of
+// policy are left to the spec's defaults.
+func (b *Bot) EnableRoomEncryption(c context.Context, room_id string, policy RotationPolicy) error {
+	content := map[string]interface{}{
+		"algorithm": megolmAlgorithm,
+	}
+
+	if policy.Period > 0 {
+		content["rotation_period_ms"] = int64(policy.Period / time.Millisecond)
+	}
+
+	if policy.Messages > 0 {
+		content["rotation_period_msgs"] = policy.Messages
+	}
+
+	if _, err := b.SetRoomState(c, room_id, "m.room.encryption", "", content); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotationPolicies[room_id] = rotationPolicyFromContent(map[string]interface{}{
+		"rotation_period_ms":   float64(policy.Period / time.Millisecond),
+		"rotation_period_msgs": float64(policy.Messages),
+	})
+	return nil
+}
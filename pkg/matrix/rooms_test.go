@@ -0,0 +1,154 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateRoom(t *testing.T) {
+	var created map[string]interface{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, "/_matrix/client/unstable/createRoom", r.URL.Path)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&created))
+		fmt.Fprint(w, `{"room_id": "!new:example.org"}`)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	powerLevels := DefaultPowerLevels()
+	powerLevels.EventsDefault = 50
+	powerLevels.Users["@admin:example.org"] = 100
+
+	room_id, err := bot.CreateRoom(context.TODO(), RoomOptions{
+		Name:        "Alerts",
+		Topic:       "Alerts from monitoring",
+		Preset:      PresetPrivateChat,
+		Invite:      []string{"@admin:example.org"},
+		Encrypted:   true,
+		PowerLevels: powerLevels,
+		InitialState: []InitialStateEvent{
+			{Type: "m.room.history_visibility", Content: map[string]string{"history_visibility": "joined"}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "!new:example.org", room_id)
+
+	assert.Equal(t, "Alerts", created["name"])
+	assert.Equal(t, "Alerts from monitoring", created["topic"])
+	assert.Equal(t, "private_chat", created["preset"])
+	assert.Equal(t, "private", created["visibility"])
+	assert.Equal(t, []interface{}{"@admin:example.org"}, created["invite"])
+
+	override := created["power_level_content_override"].(map[string]interface{})
+	assert.Equal(t, float64(50), override["events_default"])
+	assert.Equal(t, map[string]interface{}{
+		"@bot:example.org":   float64(100),
+		"@admin:example.org": float64(100),
+	}, override["users"])
+	// The caller's power levels are left alone.
+	assert.Equal(t, 1, len(powerLevels.Users))
+
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"type":    "m.room.history_visibility",
+			"content": map[string]interface{}{"history_visibility": "joined"},
+		},
+		map[string]interface{}{
+			"type":    "m.room.encryption",
+			"content": map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"},
+		},
+	}, created["initial_state"])
+
+	// The bot does not need to join the room, or fetch its encryption settings.
+	assert.Nil(t, bot.JoinRoom(context.TODO(), room_id))
+	policy, err := bot.RoomRotationPolicy(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultRotationPeriod, policy.Period)
+}
+
+func TestRoomState(t *testing.T) {
+	state := map[string]string{
+		"/_matrix/client/unstable/rooms/!room:example.org/state/m.room.name/":         `{"name": "Alerts"}`,
+		"/_matrix/client/unstable/rooms/!room:example.org/state/m.room.power_levels/": `{"users": {"@bot:example.org": 100}, "kick": 75}`,
+		"/_matrix/client/unstable/rooms/!room:example.org/state/m.room.join_rules/":   `{"join_rule": "invite"}`,
+	}
+	set := map[string]map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == "PUT" {
+			content := map[string]interface{}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&content))
+			set[r.URL.Path] = content
+			fmt.Fprint(w, `{"event_id": "$event"}`)
+			return
+		}
+
+		content, ok := state[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_NOT_FOUND", "error": "Event not found"}`)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	room_id := "!room:example.org"
+
+	name, err := bot.RoomName(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Alerts", name)
+
+	topic, err := bot.RoomTopic(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, "", topic)
+
+	joinRule, err := bot.RoomJoinRule(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, JoinRuleInvite, joinRule)
+
+	powerLevels, err := bot.RoomPowerLevels(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, 75, powerLevels.Kick)
+	assert.Equal(t, 50, powerLevels.Ban)
+	assert.Equal(t, 100, powerLevels.Users["@bot:example.org"])
+
+	encrypted, _, err := bot.RoomEncryption(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.False(t, encrypted)
+
+	assert.Nil(t, bot.SetRoomTopic(context.TODO(), room_id, "New topic"))
+	assert.Nil(t, bot.SetRoomJoinRule(context.TODO(), room_id, JoinRulePublic))
+	assert.Nil(t, bot.EnableRoomEncryption(context.TODO(), room_id, RotationPolicy{Messages: 10}))
+
+	prefix := "/_matrix/client/unstable/rooms/!room:example.org/state/"
+	assert.Equal(t, map[string]interface{}{"topic": "New topic"}, set[prefix+"m.room.topic/"])
+	assert.Equal(t, map[string]interface{}{"join_rule": "public"}, set[prefix+"m.room.join_rules/"])
+	assert.Equal(t, map[string]interface{}{
+		"algorithm":            "m.megolm.v1.aes-sha2",
+		"rotation_period_msgs": float64(10),
+	}, set[prefix+"m.room.encryption/"])
+
+	// The new settings are used for the next group session.
+	policy, err := bot.RoomRotationPolicy(context.TODO(), room_id)
+	assert.Nil(t, err)
+	assert.Equal(t, RotationPolicy{Period: 7 * 24 * time.Hour, Messages: 10}, policy)
+
+	eventId, err := bot.SetRoomState(context.TODO(), room_id, "org.example.config", "key", map[string]string{"a": "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, "$event", eventId)
+	assert.Equal(t, map[string]interface{}{"a": "b"}, set[prefix+"org.example.config/key"])
+}
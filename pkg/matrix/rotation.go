@@ -0,0 +1,176 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/justinbarrick/go-matrix/pkg/client/room_participation"
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+)
+
+// The defaults from the spec for rooms whose m.room.encryption event does not set a
+// rotation period.
+const (
+	defaultRotationPeriod     = 7 * 24 * time.Hour
+	defaultRotationPeriodMsgs = 100
+)
+
+// How long an outbound group session may be used in a room before it is replaced.
+type RotationPolicy struct {
+	// The maximum age of a session.
+	Period time.Duration
+	// The maximum number of messages encrypted with a session.
+	Messages uint32
+}
+
+// Read the rotation policy from the content of an m.room.encryption event.
+func rotationPolicyFromContent(content map[string]interface{}) RotationPolicy {
+	policy := RotationPolicy{
+		Period:   defaultRotationPeriod,
+		Messages: defaultRotationPeriodMsgs,
+	}
+
+	if ms, ok := contentNumber(content, "rotation_period_ms"); ok && ms > 0 {
+		policy.Period = time.Duration(ms) * time.Millisecond
+	}
+
+	if msgs, ok := contentNumber(content, "rotation_period_msgs"); ok && msgs > 0 {
+		policy.Messages = uint32(msgs)
+	}
+
+	return policy
+}
+
+// Get the rotation policy of a room, fetching its m.room.encryption state if it has not
+// been seen over sync yet.
+func (b *Bot) RoomRotationPolicy(c context.Context, room_id string) (RotationPolicy, error) {
+	b.lock.Lock()
+	policy, ok := b.rotationPolicies[room_id]
+	b.lock.Unlock()
+
+	if ok {
+		return policy, nil
+	}
+
+	params := room_participation.NewGetRoomStateByTypeParamsWithContext(c)
+	params.SetRoomID(room_id)
+	params.SetEventType("m.room.encryption")
+
+	content := map[string]interface{}{}
+
+	var notFound *room_participation.GetRoomStateByTypeNotFound
+
+	state, err := b.client.RoomParticipation.GetRoomStateByType(params, b)
+	if err == nil {
+		content, _ = state.Payload.(map[string]interface{})
+	} else if !errors.As(err, &notFound) {
+		return RotationPolicy{}, fmt.Errorf("Could not fetch room encryption settings: %w", err)
+	}
+
+	policy = rotationPolicyFromContent(content)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotationPolicies[room_id] = policy
+	return policy, nil
+}
+
+// Whether an outbound group session must be replaced because it is too old, has
+// encrypted too many messages or was shared with a device that is no longer in the
+// room. b.lock must be held.
+func (b *Bot) shouldRotate(session *megolm.OutboundSession, policy RotationPolicy, room_id string, members []string, deviceKeys models.QueryKeysOKBodyDeviceKeys) bool {
+	if time.Since(session.CreationTime()) >= policy.Period || session.MessageIndex() >= policy.Messages {
+		return true
+	}
+
+	current := map[string]bool{}
+	for _, destId := range members {
+		for destDeviceId := range deviceKeys[destId] {
+			current[deviceKey(destId, destDeviceId)] = true
+		}
+	}
+
+	for device := range b.shookDevices[room_id] {
+		if !current[device] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Discard the outbound group session of a room if the room's rotation policy or
+// membership requires it, so that the next message is sent with a new session that is
+// only shared with the current devices. The room lock must be held.
+func (b *Bot) rotateGroupSessionIfNeeded(c context.Context, room_id string, members []string, deviceKeys models.QueryKeysOKBodyDeviceKeys) error {
+	b.lock.Lock()
+	_, ok := b.groupSessions[room_id]
+	b.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	policy, err := b.RoomRotationPolicy(c, room_id)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if session, ok := b.groupSessions[room_id]; ok && b.shouldRotate(session, policy, room_id, members, deviceKeys) {
+		b.rotateGroupSession(room_id)
+	}
+
+	return nil
+}
+
+// Discard the outbound group session of a room so that the next encrypted message
+// starts a new one. The inbound copy is kept so that earlier messages stay decryptable.
+// Waits for encrypted sends to the room that are in progress.
+func (b *Bot) RotateGroupSession(room_id string) {
+	lock := b.roomLock(room_id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotateGroupSession(room_id)
+}
+
+// b.lock must be held.
+func (b *Bot) rotateGroupSession(room_id string) {
+	delete(b.groupSessions, room_id)
+	delete(b.shookDevices, room_id)
+}
+
+// Keep track of state changes that affect the outbound group session of a room. Only
+// timeline membership events are new, the state block also holds members who left long
+// ago.
+func (b *Bot) handleRoomStateEvent(kind EventKind, event *Event) {
+	if event.StateKey == nil {
+		return
+	}
+
+	switch event.Type {
+	case "m.room.encryption":
+		b.lock.Lock()
+		b.rotationPolicies[event.RoomId] = rotationPolicyFromContent(event.Content)
+		b.lock.Unlock()
+	case "m.room.member":
+		if kind != TimelineEvent {
+			return
+		}
+
+		switch contentString(event.Content, "membership") {
+		case "leave", "ban":
+			b.RotateGroupSession(event.RoomId)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotationPolicyFromContent(t *testing.T) {
+	assert.Equal(t, RotationPolicy{defaultRotationPeriod, defaultRotationPeriodMsgs}, rotationPolicyFromContent(nil))
+	assert.Equal(t, RotationPolicy{time.Hour, 10}, rotationPolicyFromContent(map[string]interface{}{
+		"algorithm":            megolmAlgorithm,
+		"rotation_period_ms":   float64(3600000),
+		"rotation_period_msgs": float64(10),
+	}))
+}
+
+func TestShouldRotate(t *testing.T) {
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+
+	session, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+
+	members := []string{"@alice:example.org"}
+	deviceKeys := models.QueryKeysOKBodyDeviceKeys{
+		"@alice:example.org": {"ALICE": models.QueryKeysOKBodyDeviceKeysAdditionalPropertiesAdditionalProperties{}},
+	}
+	bot.shookDevices["!room:example.org"] = map[string]bool{deviceKey("@alice:example.org", "ALICE"): true}
+
+	policy := RotationPolicy{time.Hour, 2}
+	assert.False(t, bot.shouldRotate(session, policy, "!room:example.org", members, deviceKeys))
+
+	session.Encrypt("one")
+	session.Encrypt("two")
+	assert.True(t, bot.shouldRotate(session, policy, "!room:example.org", members, deviceKeys))
+	assert.True(t, bot.shouldRotate(session, RotationPolicy{0, 100}, "!room:example.org", members, deviceKeys))
+
+	bot.shookDevices["!room:example.org"][deviceKey("@bob:example.org", "BOB")] = true
+	assert.True(t, bot.shouldRotate(session, RotationPolicy{time.Hour, 100}, "!room:example.org", members, deviceKeys))
+}
+
+func TestRoomRotationPolicy(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/rooms/!encrypted:example.org/state/m.room.encryption":
+			fmt.Fprint(w, `{"algorithm": "m.megolm.v1.aes-sha2", "rotation_period_msgs": 5}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errcode": "M_NOT_FOUND"}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	policy, err := bot.RoomRotationPolicy(context.TODO(), "!encrypted:example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationPolicy{defaultRotationPeriod, 5}, policy)
+
+	policy, err = bot.RoomRotationPolicy(context.TODO(), "!encrypted:example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationPolicy{defaultRotationPeriod, 5}, policy)
+	assert.Equal(t, 1, requests)
+
+	policy, err = bot.RoomRotationPolicy(context.TODO(), "!plain:example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, RotationPolicy{defaultRotationPeriod, defaultRotationPeriodMsgs}, policy)
+}
+
+func TestSyncRotatesSessionWhenMemberLeaves(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"next_batch": "s2",
+			"rooms": {"join": {
+				"!room:example.org": {"timeline": {"events": [
+					{"type": "m.room.encryption", "state_key": "", "event_id": "$1", "sender": "@alice:example.org", "content": {"rotation_period_msgs": 5}},
+					{"type": "m.room.member", "state_key": "@bob:example.org", "event_id": "$2", "sender": "@bob:example.org", "content": {"membership": "leave"}}
+				]}},
+				"!other:example.org": {"state": {"events": [
+					{"type": "m.room.member", "state_key": "@carol:example.org", "event_id": "$3", "sender": "@carol:example.org", "content": {"membership": "leave"}}
+				]}}
+			}}
+		}`)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	session, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	bot.groupSessions["!room:example.org"] = session
+	bot.shookDevices["!room:example.org"] = map[string]bool{deviceKey("@bob:example.org", "BOB"): true}
+
+	other, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	bot.groupSessions["!other:example.org"] = other
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	assert.Nil(t, bot.groupSessions["!room:example.org"])
+	assert.Nil(t, bot.shookDevices["!room:example.org"])
+	assert.Equal(t, uint32(5), bot.rotationPolicies["!room:example.org"].Messages)
+
+	// Members who left before the state block was sent do not rotate the session.
+	assert.Equal(t, other, bot.groupSessions["!other:example.org"])
+}
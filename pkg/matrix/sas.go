@@ -0,0 +1,526 @@
+package matrix
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The only verification method and parameters we support. The original
+// hkdf-hmac-sha256 MAC was encoded incorrectly by libolm, so only its fixed
+// successor is offered.
+const (
+	sasMethod       = "m.sas.v1"
+	sasKeyAgreement = "curve25519-hkdf-sha256"
+	sasHash         = "sha256"
+	sasMac          = "hkdf-hmac-sha256.v2"
+)
+
+// An emoji that is part of a short authentication string, with the name every client
+// displays next to it.
+type SASEmoji struct {
+	Emoji       string
+	Description string
+}
+
+var sasEmoji = []SASEmoji{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// The short authentication string both devices display so that the user can check
+// that nobody is intercepting the verification.
+type SAS struct {
+	Emoji   []SASEmoji
+	Decimal [3]int
+}
+
+// Build the emoji and decimal representations from 6 bytes of shared key material.
+func newSAS(data []byte) *SAS {
+	sas := &SAS{
+		Decimal: [3]int{
+			(int(data[0])<<5 | int(data[1])>>3) + 1000,
+			(int(data[1]&0x7)<<10 | int(data[2])<<2 | int(data[3])>>6) + 1000,
+			(int(data[3]&0x3f)<<7 | int(data[4])>>1) + 1000,
+		},
+	}
+
+	bits := uint64(0)
+	for _, b := range data[:6] {
+		bits = bits<<8 | uint64(b)
+	}
+
+	for i := 0; i < 7; i++ {
+		sas.Emoji = append(sas.Emoji, sasEmoji[(bits>>uint(42-6*i))&0x3f])
+	}
+
+	return sas
+}
+
+func (s *SAS) String() string {
+	emoji := []string{}
+	for _, e := range s.Emoji {
+		emoji = append(emoji, fmt.Sprintf("%s %s", e.Emoji, e.Description))
+	}
+
+	return fmt.Sprintf("%s\n%d %d %d", strings.Join(emoji, "  "), s.Decimal[0], s.Decimal[1], s.Decimal[2])
+}
+
+// Called with the short authentication string once it is known, it must return true
+// only if the user confirmed that the other device shows the same one.
+type SASConfirmFunc func(sas *SAS) bool
+
+// An error that ends a verification, sent to the other device as
+// m.key.verification.cancel.
+type verificationError struct {
+	code   string
+	reason string
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("Verification cancelled: %s (%s)", e.reason, e.code)
+}
+
+// The state of a SAS verification with another device.
+type sasVerification struct {
+	txnId    string
+	userId   string
+	deviceId string
+
+	// The content of the m.key.verification.start that is in effect and whether we
+	// sent it.
+	start       map[string]interface{}
+	startedByUs bool
+
+	privateKey *ecdh.PrivateKey
+	commitment string
+	theirKey   string
+	secret     []byte
+	sas        *SAS
+
+	confirmed    bool
+	theirMac     map[string]interface{}
+	macVerified  bool
+	doneSent     bool
+	doneReceived bool
+	err          error
+}
+
+func (v *sasVerification) ourKey() string {
+	return base64.RawStdEncoding.EncodeToString(v.privateKey.PublicKey().Bytes())
+}
+
+func containsString(values interface{}, value string) bool {
+	list, _ := values.([]interface{})
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Derive the MAC of a key or list of key IDs, sent from one device to the other.
+func calculateSASMac(secret []byte, fromUser, fromDevice, toUser, toDevice, txnId, keyId, input string) string {
+	info := "MATRIX_KEY_VERIFICATION_MAC" + fromUser + fromDevice + toUser + toDevice + txnId + keyId
+	mac := hmac.New(sha256.New, hkdfSHA256(secret, nil, []byte(info), 32))
+	mac.Write([]byte(input))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The commitment the accepting device sends so that it cannot pick its key after
+// seeing ours.
+func sasCommitment(key string, start map[string]interface{}) (string, error) {
+	encoded, err := canonicalJSON(start)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(append([]byte(key), encoded...))
+	return base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
+
+func (b *Bot) sendVerificationEvent(c context.Context, v *sasVerification, eventType string, content map[string]interface{}) error {
+	content["transaction_id"] = v.txnId
+	return b.SendToDevice(c, v.userId, v.deviceId, eventType, content)
+}
+
+// Cancel a verification and tell the other device why.
+func (b *Bot) cancelVerification(c context.Context, v *sasVerification, err *verificationError) {
+	if v.err != nil {
+		return
+	}
+
+	v.err = err
+	b.sendVerificationEvent(c, v, "m.key.verification.cancel", map[string]interface{}{
+		"code":   err.code,
+		"reason": err.reason,
+	})
+}
+
+func (b *Bot) sendVerificationStart(c context.Context, v *sasVerification) error {
+	v.start = map[string]interface{}{
+		"from_device":                  b.DeviceId,
+		"method":                       sasMethod,
+		"key_agreement_protocols":      []string{sasKeyAgreement},
+		"hashes":                       []string{sasHash},
+		"message_authentication_codes": []string{sasMac},
+		"short_authentication_string":  []string{"decimal", "emoji"},
+		"transaction_id":               v.txnId,
+	}
+	v.startedByUs = true
+
+	return b.sendVerificationEvent(c, v, "m.key.verification.start", v.start)
+}
+
+// Accept the other device's m.key.verification.start, committing to our key.
+func (b *Bot) acceptVerificationStart(c context.Context, v *sasVerification, start map[string]interface{}) error {
+	if contentString(start, "method") != sasMethod {
+		return &verificationError{"m.unknown_method", "Only m.sas.v1 is supported"}
+	}
+
+	if !containsString(start["key_agreement_protocols"], sasKeyAgreement) ||
+		!containsString(start["hashes"], sasHash) ||
+		!containsString(start["message_authentication_codes"], sasMac) ||
+		!containsString(start["short_authentication_string"], "emoji") {
+		return &verificationError{"m.unknown_method", "No supported SAS parameters"}
+	}
+
+	v.start = start
+	v.startedByUs = false
+
+	commitment, err := sasCommitment(v.ourKey(), start)
+	if err != nil {
+		return &verificationError{"m.invalid_message", err.Error()}
+	}
+
+	return b.sendVerificationEvent(c, v, "m.key.verification.accept", map[string]interface{}{
+		"method":                      sasMethod,
+		"key_agreement_protocol":      sasKeyAgreement,
+		"hash":                        sasHash,
+		"message_authentication_code": sasMac,
+		"short_authentication_string": []string{"decimal", "emoji"},
+		"commitment":                  commitment,
+	})
+}
+
+// Derive the shared secret and short authentication string once both keys are known.
+func (b *Bot) computeSAS(v *sasVerification) error {
+	theirKey, err := decodeBase64(v.theirKey)
+	if err != nil {
+		return &verificationError{"m.invalid_message", "Invalid key"}
+	}
+
+	publicKey, err := ecdh.X25519().NewPublicKey(theirKey)
+	if err != nil {
+		return &verificationError{"m.invalid_message", "Invalid key"}
+	}
+
+	v.secret, err = v.privateKey.ECDH(publicKey)
+	if err != nil {
+		return &verificationError{"m.invalid_message", "Invalid key"}
+	}
+
+	// The device that sent the start event in effect comes first.
+	parties := []string{b.UserId, b.DeviceId, v.ourKey(), v.userId, v.deviceId, v.theirKey}
+	if !v.startedByUs {
+		parties = []string{v.userId, v.deviceId, v.theirKey, b.UserId, b.DeviceId, v.ourKey()}
+	}
+
+	info := "MATRIX_KEY_VERIFICATION_SAS|" + strings.Join(parties, "|") + "|" + v.txnId
+	v.sas = newSAS(hkdfSHA256(v.secret, nil, []byte(info), 6))
+	return nil
+}
+
+// Send the MAC of our device key after the user confirmed the SAS.
+func (b *Bot) sendVerificationMac(c context.Context, v *sasVerification) error {
+	keyId := fmt.Sprintf("ed25519:%s", b.DeviceId)
+
+	return b.sendVerificationEvent(c, v, "m.key.verification.mac", map[string]interface{}{
+		"mac": map[string]string{
+			keyId: calculateSASMac(v.secret, b.UserId, b.DeviceId, v.userId, v.deviceId, v.txnId, keyId, b.Olm.GetIdentityKeys().Ed25519),
+		},
+		"keys": calculateSASMac(v.secret, b.UserId, b.DeviceId, v.userId, v.deviceId, v.txnId, "KEY_IDS", keyId),
+	})
+}
+
+// Check the other device's MACs against the keys we know for it.
+func (b *Bot) checkVerificationMac(v *sasVerification) error {
+	macs, _ := v.theirMac["mac"].(map[string]interface{})
+
+	keyIds := []string{}
+	for keyId := range macs {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+
+	if calculateSASMac(v.secret, v.userId, v.deviceId, b.UserId, b.DeviceId, v.txnId, "KEY_IDS", strings.Join(keyIds, ",")) != contentString(v.theirMac, "keys") {
+		return &verificationError{"m.key_mismatch", "Key list MAC does not match"}
+	}
+
+	b.lock.Lock()
+	device := b.devices[v.userId][v.deviceId]
+	b.lock.Unlock()
+
+	deviceKeyId := fmt.Sprintf("ed25519:%s", v.deviceId)
+
+	mac, ok := macs[deviceKeyId].(string)
+	if !ok {
+		return &verificationError{"m.key_mismatch", "Device key was not included"}
+	}
+
+	if calculateSASMac(v.secret, v.userId, v.deviceId, b.UserId, b.DeviceId, v.txnId, deviceKeyId, device.Ed25519Key) != mac {
+		return &verificationError{"m.key_mismatch", "Device key MAC does not match"}
+	}
+
+	return nil
+}
+
+// Advance a verification with an m.key.verification.* event from the other device.
+// Only verifications started with VerifyDeviceSAS are known, requests and starts from
+// other devices for unknown transactions are ignored, so the bot cannot be verified
+// from another client unless the bot starts the verification.
+func (b *Bot) handleVerificationEvent(c context.Context, event *Event) {
+	b.lock.Lock()
+	v, ok := b.verifications[contentString(event.Content, "transaction_id")]
+	b.lock.Unlock()
+
+	if !ok || v.err != nil {
+		return
+	}
+
+	if event.Sender != v.userId {
+		return
+	}
+
+	if fromDevice := contentString(event.Content, "from_device"); fromDevice != "" && fromDevice != v.deviceId {
+		return
+	}
+
+	if err := b.verificationStep(c, v, event); err != nil {
+		if verr, ok := err.(*verificationError); ok {
+			b.cancelVerification(c, v, verr)
+		} else {
+			v.err = err
+		}
+	}
+}
+
+func (b *Bot) verificationStep(c context.Context, v *sasVerification, event *Event) error {
+	unexpected := &verificationError{"m.unexpected_message", fmt.Sprintf("Unexpected %s", event.Type)}
+
+	switch event.Type {
+	case "m.key.verification.ready":
+		if v.start != nil {
+			return unexpected
+		}
+
+		if !containsString(event.Content["methods"], sasMethod) {
+			return &verificationError{"m.unknown_method", "Only m.sas.v1 is supported"}
+		}
+
+		return b.sendVerificationStart(c, v)
+	case "m.key.verification.start":
+		if v.start != nil && !v.startedByUs || v.commitment != "" {
+			return unexpected
+		}
+
+		// If both devices started, the one with the lower user ID and device ID wins.
+		if v.startedByUs && (b.UserId < v.userId || b.UserId == v.userId && b.DeviceId < v.deviceId) {
+			return nil
+		}
+
+		return b.acceptVerificationStart(c, v, event.Content)
+	case "m.key.verification.accept":
+		if !v.startedByUs || v.commitment != "" {
+			return unexpected
+		}
+
+		if contentString(event.Content, "key_agreement_protocol") != sasKeyAgreement ||
+			contentString(event.Content, "hash") != sasHash ||
+			contentString(event.Content, "message_authentication_code") != sasMac ||
+			!containsString(event.Content["short_authentication_string"], "emoji") {
+			return &verificationError{"m.unknown_method", "Accepted unsupported SAS parameters"}
+		}
+
+		v.commitment = contentString(event.Content, "commitment")
+
+		return b.sendVerificationEvent(c, v, "m.key.verification.key", map[string]interface{}{
+			"key": v.ourKey(),
+		})
+	case "m.key.verification.key":
+		if v.start == nil || v.theirKey != "" || v.startedByUs && v.commitment == "" {
+			return unexpected
+		}
+
+		v.theirKey = contentString(event.Content, "key")
+
+		if v.startedByUs {
+			commitment, err := sasCommitment(v.theirKey, v.start)
+			if err != nil || commitment != v.commitment {
+				return &verificationError{"m.mismatched_commitment", "Key does not match commitment"}
+			}
+		} else {
+			err := b.sendVerificationEvent(c, v, "m.key.verification.key", map[string]interface{}{
+				"key": v.ourKey(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.computeSAS(v)
+	case "m.key.verification.mac":
+		if v.sas == nil || v.theirMac != nil {
+			return unexpected
+		}
+
+		v.theirMac = event.Content
+	case "m.key.verification.done":
+		v.doneReceived = true
+	case "m.key.verification.cancel":
+		v.err = fmt.Errorf("Verification cancelled by %s %s: %s (%s)", v.userId, v.deviceId,
+			contentString(event.Content, "reason"), contentString(event.Content, "code"))
+	}
+
+	return nil
+}
+
+// Interactively verify another device using emoji or decimal comparison. The
+// verification events are received by calling SyncOnce, so Sync must not be running
+// at the same time. confirm is called with the short authentication string and must
+// only return true if the user confirmed that the other device shows the same one.
+// On success the device is marked as verified, and the other device will show ours as
+// verified as well. Verifications requested by other devices are not answered.
+func (b *Bot) VerifyDeviceSAS(c context.Context, userId, deviceId string, confirm SASConfirmFunc) error {
+	if !b.knownDevice(userId, deviceId) {
+		if _, err := b.QueryDevices(c, userId); err != nil {
+			return err
+		}
+	}
+
+	if !b.knownDevice(userId, deviceId) {
+		return fmt.Errorf("Unknown device %s %s", userId, deviceId)
+	}
+
+	txnId, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("Could not generate uuid: %s", err)
+	}
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Could not generate key: %s", err)
+	}
+
+	v := &sasVerification{
+		txnId:      txnId.String(),
+		userId:     userId,
+		deviceId:   deviceId,
+		privateKey: privateKey,
+	}
+
+	b.lock.Lock()
+	b.verifications[v.txnId] = v
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		delete(b.verifications, v.txnId)
+		b.lock.Unlock()
+	}()
+
+	err = b.sendVerificationEvent(c, v, "m.key.verification.request", map[string]interface{}{
+		"from_device": b.DeviceId,
+		"methods":     []string{sasMethod},
+		"timestamp":   time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := syncMinBackoff
+
+	for {
+		if v.err != nil {
+			return v.err
+		}
+
+		if v.sas != nil && !v.confirmed {
+			if !confirm(v.sas) {
+				b.cancelVerification(c, v, &verificationError{"m.mismatched_sas", "The short authentication strings did not match"})
+				return v.err
+			}
+
+			v.confirmed = true
+			if err := b.sendVerificationMac(c, v); err != nil {
+				return err
+			}
+		}
+
+		if v.confirmed && v.theirMac != nil && !v.macVerified {
+			if err := b.checkVerificationMac(v); err != nil {
+				b.cancelVerification(c, v, err.(*verificationError))
+				return v.err
+			}
+
+			v.macVerified = true
+			if err := b.VerifyDevice(userId, deviceId); err != nil {
+				return err
+			}
+		}
+
+		if v.macVerified && !v.doneSent {
+			if err := b.sendVerificationEvent(c, v, "m.key.verification.done", map[string]interface{}{}); err != nil {
+				return err
+			}
+			v.doneSent = true
+		}
+
+		if v.doneSent && v.doneReceived {
+			return nil
+		}
+
+		// Sync errors are retried like Sync does, the verification only ends when c does.
+		err := b.SyncOnce(c)
+		if c.Err() != nil {
+			b.cancelVerification(context.Background(), v, &verificationError{"m.user", "Verification was aborted"})
+			return c.Err()
+		}
+
+		if err == nil {
+			backoff = syncMinBackoff
+			continue
+		}
+
+		b.syncError(err)
+
+		if !waitSyncBackoff(c, &backoff) {
+			b.cancelVerification(context.Background(), v, &verificationError{"m.user", "Verification was aborted"})
+			return c.Err()
+		}
+	}
+}
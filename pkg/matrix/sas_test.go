@@ -0,0 +1,176 @@
+package matrix
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	libolm "github.com/justinbarrick/libolm-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSAS(t *testing.T) {
+	sas := newSAS([]byte{0, 0, 0, 0, 0, 0})
+	assert.Equal(t, [3]int{1000, 1000, 1000}, sas.Decimal)
+	assert.Equal(t, 7, len(sas.Emoji))
+	assert.Equal(t, "Dog", sas.Emoji[0].Description)
+
+	sas = newSAS([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, [3]int{9191, 9191, 9191}, sas.Decimal)
+	assert.Equal(t, "Pin", sas.Emoji[6].Description)
+
+	// 000001 000010 000011 000100 000101 000110 000111 and 6 bits of padding.
+	sas = newSAS([]byte{0x04, 0x20, 0xc4, 0x14, 0x61, 0xc0})
+	descriptions := []string{}
+	for _, emoji := range sas.Emoji {
+		descriptions = append(descriptions, emoji.Description)
+	}
+	assert.Equal(t, []string{"Cat", "Lion", "Horse", "Unicorn", "Pig", "Elephant", "Rabbit"}, descriptions)
+}
+
+// A device that answers our verification requests like a well behaved client would.
+type sasPeer struct {
+	t          *testing.T
+	bot        *Bot
+	signingKey ed25519.PrivateKey
+	privateKey *ecdh.PrivateKey
+	txnId      string
+	start      map[string]interface{}
+	secret     []byte
+	sas        *SAS
+	done       bool
+	events     []map[string]interface{}
+}
+
+func (p *sasPeer) send(eventType string, content map[string]interface{}) {
+	content["transaction_id"] = p.txnId
+	p.events = append(p.events, map[string]interface{}{
+		"type":    eventType,
+		"sender":  "@alice:example.org",
+		"content": content,
+	})
+}
+
+func (p *sasPeer) receive(eventType string, content map[string]interface{}) {
+	ourKey := base64.RawStdEncoding.EncodeToString(p.privateKey.PublicKey().Bytes())
+
+	switch eventType {
+	case "m.key.verification.request":
+		p.txnId = contentString(content, "transaction_id")
+		p.send("m.key.verification.ready", map[string]interface{}{
+			"from_device": "ALICE",
+			"methods":     []string{sasMethod},
+		})
+	case "m.key.verification.start":
+		p.start = content
+		commitment, err := sasCommitment(ourKey, content)
+		assert.Nil(p.t, err)
+
+		p.send("m.key.verification.accept", map[string]interface{}{
+			"key_agreement_protocol":      sasKeyAgreement,
+			"hash":                        sasHash,
+			"message_authentication_code": sasMac,
+			"short_authentication_string": []string{"decimal", "emoji"},
+			"commitment":                  commitment,
+		})
+	case "m.key.verification.key":
+		theirKey, err := decodeBase64(contentString(content, "key"))
+		assert.Nil(p.t, err)
+		publicKey, err := ecdh.X25519().NewPublicKey(theirKey)
+		assert.Nil(p.t, err)
+		p.secret, err = p.privateKey.ECDH(publicKey)
+		assert.Nil(p.t, err)
+
+		info := strings.Join([]string{"MATRIX_KEY_VERIFICATION_SAS", "@bot:example.org", "BOTDEVICE", contentString(content, "key"),
+			"@alice:example.org", "ALICE", ourKey, p.txnId}, "|")
+		p.sas = newSAS(hkdfSHA256(p.secret, nil, []byte(info), 6))
+
+		p.send("m.key.verification.key", map[string]interface{}{"key": ourKey})
+	case "m.key.verification.mac":
+		keyId := "ed25519:BOTDEVICE"
+		assert.Equal(p.t, calculateSASMac(p.secret, "@bot:example.org", "BOTDEVICE", "@alice:example.org", "ALICE", p.txnId, "KEY_IDS", keyId), content["keys"])
+		assert.Equal(p.t, calculateSASMac(p.secret, "@bot:example.org", "BOTDEVICE", "@alice:example.org", "ALICE", p.txnId, keyId, p.bot.Olm.GetIdentityKeys().Ed25519),
+			content["mac"].(map[string]interface{})[keyId])
+
+		ed25519Key := base64.RawStdEncoding.EncodeToString(p.signingKey.Public().(ed25519.PublicKey))
+		p.send("m.key.verification.mac", map[string]interface{}{
+			"mac": map[string]string{
+				"ed25519:ALICE": calculateSASMac(p.secret, "@alice:example.org", "ALICE", "@bot:example.org", "BOTDEVICE", p.txnId, "ed25519:ALICE", ed25519Key),
+			},
+			"keys": calculateSASMac(p.secret, "@alice:example.org", "ALICE", "@bot:example.org", "BOTDEVICE", p.txnId, "KEY_IDS", "ed25519:ALICE"),
+		})
+		p.send("m.key.verification.done", map[string]interface{}{})
+	case "m.key.verification.done":
+		p.done = true
+	case "m.key.verification.cancel":
+		p.t.Fatalf("Verification was cancelled: %v", content)
+	}
+}
+
+func TestVerifyDeviceSAS(t *testing.T) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	peer := &sasPeer{t: t, signingKey: newSigningKey(t), privateKey: privateKey}
+	syncs := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/_matrix/client/unstable/keys/query":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_keys": models.QueryKeysOKBodyDeviceKeys{
+					"@alice:example.org": {"ALICE": signedDeviceKeys(t, "@alice:example.org", "ALICE", peer.signingKey)},
+				},
+			})
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/unstable/sendToDevice/"):
+			body := struct {
+				Messages map[string]map[string]map[string]interface{} `json:"messages"`
+			}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+
+			eventType := strings.Split(r.URL.Path, "/")[5]
+			peer.receive(eventType, body.Messages["@alice:example.org"]["ALICE"])
+			w.Write([]byte("{}"))
+		case r.URL.Path == "/_matrix/client/unstable/sync":
+			// A transient failure does not end the verification.
+			if syncs++; syncs == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"next_batch": "s1",
+				"to_device":  map[string]interface{}{"events": peer.events},
+			})
+			peer.events = nil
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.Olm = libolm.NewMatrix()
+	peer.bot = bot
+
+	syncErrors := 0
+	bot.OnSyncError(func(err error) {
+		syncErrors++
+	})
+
+	err = bot.VerifyDeviceSAS(context.TODO(), "@alice:example.org", "ALICE", func(sas *SAS) bool {
+		return assert.Equal(t, peer.sas, sas)
+	})
+	assert.Nil(t, err)
+	assert.True(t, peer.done)
+	assert.Equal(t, 1, syncErrors)
+	assert.Equal(t, DeviceVerified, bot.Devices("@alice:example.org")[0].Trust)
+}
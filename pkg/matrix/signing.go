@@ -0,0 +1,98 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encode an object as canonical JSON: sorted keys, no insignificant whitespace and no
+// escaping of HTML characters.
+func canonicalJSON(object interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trip through a generic value so that struct fields are sorted as well.
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Decode unpadded base64 as used for keys and signatures, accepting padded input too.
+func decodeBase64(data string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// Derive length bytes of key material from a secret using HKDF-SHA256.
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	keys := make([]byte, length)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, info), keys)
+	return keys
+}
+
+// Decode a signed JSON object, keeping numbers as they are so that it encodes to the
+// same canonical JSON that was signed.
+func decodeSignedObject(data []byte) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return object, decoder.Decode(&object)
+}
+
+// Verify the ed25519 signature made by userId with keyId over a signed JSON object.
+// The signatures and unsigned properties are not part of the signed data.
+func verifySignature(object map[string]interface{}, signatures map[string]map[string]string, userId, keyId, key string) error {
+	signature, ok := signatures[userId][keyId]
+	if !ok {
+		return fmt.Errorf("No signature from %s %s", userId, keyId)
+	}
+
+	publicKey, err := decodeBase64(key)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid ed25519 key %s", keyId)
+	}
+
+	signatureData, err := decodeBase64(signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature from %s %s", userId, keyId)
+	}
+
+	signed := map[string]interface{}{}
+	for k, v := range object {
+		if k != "signatures" && k != "unsigned" {
+			signed[k] = v
+		}
+	}
+
+	message, err := canonicalJSON(signed)
+	if err != nil {
+		return fmt.Errorf("Could not encode signed object: %s", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), message, signatureData) {
+		return fmt.Errorf("Bad signature from %s %s", userId, keyId)
+	}
+
+	return nil
+}
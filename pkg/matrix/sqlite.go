@@ -0,0 +1,106 @@
+package matrix
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS config (id INTEGER PRIMARY KEY CHECK (id = 0), data BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS next_batch (user_id TEXT PRIMARY KEY, next_batch TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS crypto_state (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	state BLOB NOT NULL,
+	PRIMARY KEY (user_id, device_id)
+);
+`
+
+// A Store backed by a SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Open or create a SQLite database at path and create its tables.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("SQLite store needs a path")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open database: %s", err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create tables: %s", err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) LoadConfig() ([]byte, error) {
+	data := []byte{}
+	err := s.db.QueryRow("SELECT data FROM config WHERE id = 0").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (s *SQLiteStore) SaveConfig(data []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO config (id, data) VALUES (0, ?)", data)
+	return err
+}
+
+func (s *SQLiteStore) LoadNextBatch(userId string) (string, error) {
+	nextBatch := ""
+	err := s.db.QueryRow("SELECT next_batch FROM next_batch WHERE user_id = ?", userId).Scan(&nextBatch)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return nextBatch, err
+}
+
+func (s *SQLiteStore) SaveNextBatch(userId, nextBatch string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO next_batch (user_id, next_batch) VALUES (?, ?)", userId, nextBatch)
+	return err
+}
+
+func (s *SQLiteStore) LoadCryptoState(userId, deviceId string) (*CryptoState, error) {
+	state := &CryptoState{}
+
+	data := []byte{}
+	err := s.db.QueryRow("SELECT state FROM crypto_state WHERE user_id = ? AND device_id = ?", userId, deviceId).Scan(&data)
+	if err == sql.ErrNoRows {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return state, json.Unmarshal(data, state)
+}
+
+func (s *SQLiteStore) SaveCryptoState(userId, deviceId string, state *CryptoState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO crypto_state (user_id, device_id, state) VALUES (?, ?, ?)", userId, deviceId, data)
+	return err
+}
@@ -0,0 +1,241 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Persists a bot's serialized credentials.
+type ConfigStore interface {
+	// Load the serialized bot, which may be encrypted. Returns an error if nothing has
+	// been saved yet.
+	LoadConfig() ([]byte, error)
+	SaveConfig(data []byte) error
+}
+
+// Persists everything a bot needs to restart: its credentials, its sync token and its
+// encryption state.
+type Store interface {
+	ConfigStore
+	SyncStore
+	CryptoStore
+}
+
+// Save the bot's credentials to store, encrypted with key unless it is empty.
+func SaveBot(store Store, b Bot, key string) error {
+	data, err := encodeBot(b, key)
+	if err != nil {
+		return err
+	}
+
+	if err := store.SaveConfig(data); err != nil {
+		return fmt.Errorf("Could not save config: %s", err)
+	}
+
+	return nil
+}
+
+// Save a bot loaded with LoadBot back to store with a new key: its credentials and its
+// encryption state are encrypted with key, or decrypted if key is empty.
+func RekeyBot(store Store, b Bot, key string) error {
+	b.lock.Lock()
+	b.pickleKey = key
+	b.cryptoStateSealer = nil
+	b.cryptoStore = store
+	b.lock.Unlock()
+
+	if err := b.saveCryptoState(); err != nil {
+		return err
+	}
+
+	return SaveBot(store, b, key)
+}
+
+// Load a bot saved with SaveBot and restore its sync token and encryption state from
+// the same store. Credentials that change later, such as refreshed access tokens, are
+// saved back to it.
+func LoadBot(store Store, key string) (Bot, error) {
+	data, err := store.LoadConfig()
+	if err != nil {
+		return Bot{}, fmt.Errorf("Could not load config: %s", err)
+	}
+
+	b, err := decodeBot(data, key)
+	if err != nil {
+		return b, err
+	}
+
+	b.SetConfigStore(store, key)
+	b.SetSyncStore(store)
+	return b, b.SetCryptoStore(store)
+}
+
+// A Store that keeps each kind of state in its own file, the layout matrixctl has
+// always used.
+type FileStore struct {
+	ConfigPath string
+	SyncPath   string
+	CryptoPath string
+}
+
+func (f FileStore) LoadConfig() ([]byte, error) {
+	return ioutil.ReadFile(f.ConfigPath)
+}
+
+func (f FileStore) SaveConfig(data []byte) error {
+	return writeFileAtomic(f.ConfigPath, data)
+}
+
+func (f FileStore) LoadNextBatch(userId string) (string, error) {
+	return FileSyncStore(f.SyncPath).LoadNextBatch(userId)
+}
+
+func (f FileStore) SaveNextBatch(userId, nextBatch string) error {
+	return FileSyncStore(f.SyncPath).SaveNextBatch(userId, nextBatch)
+}
+
+func (f FileStore) LoadCryptoState(userId, deviceId string) (*CryptoState, error) {
+	return FileCryptoStore(f.CryptoPath).LoadCryptoState(userId, deviceId)
+}
+
+func (f FileStore) SaveCryptoState(userId, deviceId string, state *CryptoState) error {
+	return FileCryptoStore(f.CryptoPath).SaveCryptoState(userId, deviceId, state)
+}
+
+// A Store with the files matrixctl keeps by default: the sync token next to the config
+// and crypto.json in the same directory.
+func configFileStore(configPath string) FileStore {
+	return FileStore{
+		ConfigPath: configPath,
+		SyncPath:   configPath + ".next_batch",
+		CryptoPath: filepath.Join(filepath.Dir(configPath), "crypto.json"),
+	}
+}
+
+// A Store that keeps its files in a directory, convenient for a single volume mount. The
+// files are named like matrixctl's defaults in ~/.matrix.
+func DirStore(dir string) FileStore {
+	return configFileStore(filepath.Join(dir, "config.json"))
+}
+
+// A Store that only keeps state in memory, for tests.
+type MemoryStore struct {
+	lock       sync.Mutex
+	config     []byte
+	nextBatch  map[string]string
+	cryptoData map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextBatch:  map[string]string{},
+		cryptoData: map[string][]byte{},
+	}
+}
+
+func (m *MemoryStore) LoadConfig() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.config == nil {
+		return nil, os.ErrNotExist
+	}
+	return m.config, nil
+}
+
+func (m *MemoryStore) SaveConfig(data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.config = data
+	return nil
+}
+
+func (m *MemoryStore) LoadNextBatch(userId string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.nextBatch[userId], nil
+}
+
+func (m *MemoryStore) SaveNextBatch(userId, nextBatch string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextBatch[userId] = nextBatch
+	return nil
+}
+
+// The state is kept serialized so that later changes to the bot's sessions are not
+// visible until they are saved, like with the other stores.
+func (m *MemoryStore) LoadCryptoState(userId, deviceId string) (*CryptoState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	state := &CryptoState{}
+	data, ok := m.cryptoData[deviceKey(userId, deviceId)]
+	if !ok {
+		return state, nil
+	}
+
+	return state, json.Unmarshal(data, state)
+}
+
+func (m *MemoryStore) SaveCryptoState(userId, deviceId string, state *CryptoState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.cryptoData[deviceKey(userId, deviceId)] = data
+	return nil
+}
+
+// Open a store from a URL:
+//
+//	file:///path/config.json   the config with next_batch and crypto.json beside it
+//	dir:///path                a directory of files, see DirStore
+//	sqlite:///path/matrix.db   a SQLite database
+//	memory:                    an in-memory store
+//
+// A URL without a scheme is treated as a file path.
+func OpenStore(storeUrl string) (Store, error) {
+	parsed, err := url.Parse(storeUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse store URL: %s", err)
+	}
+
+	path := parsed.Host + parsed.Path
+	if parsed.Opaque != "" {
+		path = parsed.Opaque
+	}
+
+	switch parsed.Scheme {
+	case "", "file":
+		if path == "" {
+			return nil, fmt.Errorf("File store needs a path")
+		}
+
+		return configFileStore(path), nil
+	case "dir":
+		if path == "" {
+			return nil, fmt.Errorf("Directory store needs a path")
+		}
+
+		return DirStore(path), nil
+	case "sqlite":
+		return OpenSQLiteStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported store: %s", parsed.Scheme)
+	}
+}
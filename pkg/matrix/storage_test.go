@@ -0,0 +1,124 @@
+package matrix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stores")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sqlite, err := OpenSQLiteStore(filepath.Join(dir, "matrix.db"))
+	assert.Nil(t, err)
+	defer sqlite.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"dir":    DirStore(filepath.Join(dir, "state")),
+		"sqlite": sqlite,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadBot(store, "")
+			assert.NotNil(t, err)
+
+			bot, err := NewBot("example.org")
+			assert.Nil(t, err)
+			bot.UserId = "@bot:example.org"
+			bot.DeviceId = "BOTDEVICE"
+			bot.AccessToken = "token"
+
+			assert.Nil(t, SaveBot(store, bot, ""))
+			assert.Nil(t, store.SaveNextBatch(bot.UserId, "s1"))
+			assert.Nil(t, store.SaveNextBatch(bot.UserId, "s2"))
+			assert.Nil(t, store.SaveCryptoState(bot.UserId, bot.DeviceId, &CryptoState{DeviceListToken: "s2"}))
+
+			restored, err := LoadBot(store, "")
+			assert.Nil(t, err)
+			assert.Equal(t, "token", restored.AccessToken)
+			assert.Equal(t, "s2", restored.deviceListToken)
+
+			nextBatch, err := store.LoadNextBatch(bot.UserId)
+			assert.Nil(t, err)
+			assert.Equal(t, "s2", nextBatch)
+		})
+	}
+}
+
+func TestRekeyBot(t *testing.T) {
+	store := NewMemoryStore()
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	bot.UserId = "@bot:example.org"
+	bot.DeviceId = "BOTDEVICE"
+	bot.AccessToken = "token"
+	assert.Nil(t, SaveBot(store, bot, ""))
+
+	loaded, err := LoadBot(store, "")
+	assert.Nil(t, err)
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	loaded.groupSessions["!room:example.org"] = outbound
+	assert.Nil(t, loaded.saveCryptoState())
+
+	encrypted, err := LoadBot(store, "")
+	assert.Nil(t, err)
+	assert.Nil(t, RekeyBot(store, encrypted, "config key"))
+
+	state, err := store.LoadCryptoState(bot.UserId, bot.DeviceId)
+	assert.Nil(t, err)
+	assert.NotNil(t, state.Encrypted)
+
+	_, err = LoadBot(store, "")
+	assert.NotNil(t, err)
+	_, err = LoadBot(store, "wrong key")
+	assert.NotNil(t, err)
+
+	decrypted, err := LoadBot(store, "config key")
+	assert.Nil(t, err)
+	assert.Nil(t, RekeyBot(store, decrypted, ""))
+
+	state, err = store.LoadCryptoState(bot.UserId, bot.DeviceId)
+	assert.Nil(t, err)
+	assert.Nil(t, state.Encrypted)
+	assert.False(t, state.OlmSessionsKeyed)
+
+	restored, err := LoadBot(store, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "token", restored.AccessToken)
+	assert.Equal(t, outbound.GetSessionID(), restored.groupSessions["!room:example.org"].GetSessionID())
+}
+
+func TestOpenStore(t *testing.T) {
+	store, err := OpenStore("/etc/matrix/config.json")
+	assert.Nil(t, err)
+	assert.Equal(t, FileStore{
+		ConfigPath: "/etc/matrix/config.json",
+		SyncPath:   "/etc/matrix/config.json.next_batch",
+		CryptoPath: "/etc/matrix/crypto.json",
+	}, store)
+
+	store, err = OpenStore("dir:///var/lib/matrix")
+	assert.Nil(t, err)
+	assert.Equal(t, FileStore{
+		ConfigPath: "/var/lib/matrix/config.json",
+		SyncPath:   "/var/lib/matrix/config.json.next_batch",
+		CryptoPath: "/var/lib/matrix/crypto.json",
+	}, store)
+
+	store, err = OpenStore("memory:")
+	assert.Nil(t, err)
+	assert.IsType(t, &MemoryStore{}, store)
+
+	_, err = OpenStore("s3://bucket/config.json")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,293 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/justinbarrick/go-matrix/pkg/models"
+	libolm "github.com/justinbarrick/libolm-go"
+)
+
+// The key the Olm account and sessions are pickled with when no config key is given,
+// the fixed key libolm-go uses.
+const defaultPickleKey = "lol"
+
+// The end-to-end encryption state of a bot that must survive restarts so that the bot
+// does not need to re-establish sessions with every device and old messages stay
+// decryptable.
+type CryptoState struct {
+	// Our outbound Megolm sessions, keyed by room ID.
+	OutboundGroupSessions map[string]*megolm.OutboundSession `json:"outboundGroupSessions"`
+	// Megolm sessions for decrypting room events, keyed by room ID, sender key and
+	// session ID.
+	InboundGroupSessions map[string]*megolm.InboundSession `json:"inboundGroupSessions"`
+	// The ed25519 keys claimed by the senders of the inbound group sessions, with the
+	// same keys.
+	SenderClaimedKeys map[string]string `json:"senderClaimedKeys,omitempty"`
+	// Pickled Olm sessions, keyed by the other device's curve25519 identity key.
+	OlmSessions map[string][]string `json:"olmSessions"`
+	// True if the Olm sessions were pickled with the config key rather than the
+	// default key.
+	OlmSessionsKeyed bool `json:"olmSessionsKeyed,omitempty"`
+	// The devices that have received our outbound session key, keyed by room ID.
+	SharedDevices map[string]map[string]bool `json:"sharedDevices"`
+	// The devices we have seen and how much we trust them, keyed by user ID and device
+	// ID.
+	Devices map[string]map[string]*Device `json:"devices"`
+	// The cached device keys of users we share rooms with and the sync token they are
+	// current as of.
+	DeviceKeys      map[string]models.QueryKeysOKBodyDeviceKeysAdditionalProperties `json:"deviceKeys"`
+	DeviceListToken string                                                          `json:"deviceListToken"`
+	// Our private cross-signing keys, if cross-signing has been bootstrapped.
+	CrossSigning *CrossSigningKeys `json:"crossSigning,omitempty"`
+	// The server-side key backup and the inbound group sessions uploaded to it.
+	KeyBackup        *KeyBackup      `json:"keyBackup,omitempty"`
+	BackedUpSessions map[string]bool `json:"backedUpSessions"`
+	// The event IDs of decrypted Megolm messages by inbound group session and message
+	// index, to detect replayed messages.
+	MessageIndexes map[string]map[uint32]string `json:"messageIndexes,omitempty"`
+	// The rest of the state encrypted with the config key, in the same format as an
+	// encrypted config. The other fields are empty when it is set.
+	Encrypted json.RawMessage `json:"encrypted,omitempty"`
+}
+
+// Persists a bot's end-to-end encryption state.
+type CryptoStore interface {
+	// Load the saved state, returning an empty state if nothing has been saved yet.
+	LoadCryptoState(userId, deviceId string) (*CryptoState, error)
+	SaveCryptoState(userId, deviceId string, state *CryptoState) error
+}
+
+// A CryptoStore that keeps the state in a JSON file on disk.
+type FileCryptoStore string
+
+func (f FileCryptoStore) LoadCryptoState(userId, deviceId string) (*CryptoState, error) {
+	state := &CryptoState{}
+
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return state, json.Unmarshal(data, state)
+}
+
+func (f FileCryptoStore) SaveCryptoState(userId, deviceId string, state *CryptoState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(string(f), data)
+}
+
+// Write a file by renaming a temporary file over it so that a crash never leaves a
+// truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Set the store used to persist the bot's encryption state and load any state that
+// was previously saved to it.
+func (b *Bot) SetCryptoStore(store CryptoStore) error {
+	state, err := store.LoadCryptoState(b.UserId, b.DeviceId)
+	if err != nil {
+		return fmt.Errorf("Could not load crypto state: %s", err)
+	}
+
+	if state, err = decryptCryptoState(state, b.pickleKey); err != nil {
+		return err
+	}
+
+	pickleKey := defaultPickleKey
+	if state.OlmSessionsKeyed {
+		if b.pickleKey == "" {
+			return fmt.Errorf("Crypto state was saved with an encrypted config, set the config key")
+		}
+		pickleKey = b.pickleKey
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for roomId, session := range state.OutboundGroupSessions {
+		b.groupSessions[roomId] = session
+	}
+
+	for key, session := range state.InboundGroupSessions {
+		b.inboundGroupSessions[key] = session
+	}
+
+	for key, claimedKey := range state.SenderClaimedKeys {
+		b.senderClaimedKeys[key] = claimedKey
+	}
+
+	for senderKey, pickles := range state.OlmSessions {
+		sessions := []libolm.Session{}
+		for _, pickle := range pickles {
+			sessions = append(sessions, libolm.SessionFromPickle(pickleKey, pickle))
+		}
+		b.olmSessions[senderKey] = sessions
+	}
+
+	for roomId, devices := range state.SharedDevices {
+		b.shookDevices[roomId] = devices
+	}
+
+	for userId, devices := range state.Devices {
+		b.devices[userId] = devices
+	}
+
+	for userId, deviceKeys := range state.DeviceKeys {
+		b.deviceKeyCache[userId] = deviceKeys
+	}
+	b.deviceListToken = state.DeviceListToken
+	b.crossSigningKeys = state.CrossSigning
+	b.keyBackup = state.KeyBackup
+	for key, backedUp := range state.BackedUpSessions {
+		b.backedUpSessions[key] = backedUp
+	}
+	for key, indexes := range state.MessageIndexes {
+		b.messageIndexes[key] = indexes
+	}
+
+	b.cryptoStore = store
+	return nil
+}
+
+// Encrypt the whole crypto state with the config key so that session keys and private
+// keys are not stored in plaintext. b.lock must be held.
+func (b *Bot) encryptCryptoState(state *CryptoState) (*CryptoState, error) {
+	if b.cryptoStateSealer == nil {
+		sealer, err := newConfigSealer(b.pickleKey)
+		if err != nil {
+			return nil, err
+		}
+		b.cryptoStateSealer = sealer
+	}
+
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := b.cryptoStateSealer.seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+
+	return &CryptoState{Encrypted: sealed["encrypted"]}, nil
+}
+
+// Decrypt a crypto state encrypted by encryptCryptoState, returning it unchanged if it
+// is not encrypted.
+func decryptCryptoState(state *CryptoState, key string) (*CryptoState, error) {
+	if state.Encrypted == nil {
+		return state, nil
+	}
+
+	if key == "" {
+		return nil, fmt.Errorf("Crypto state is encrypted, set MATRIX_CONFIG_KEY or MATRIX_CONFIG_KEY_FILE")
+	}
+
+	data, err := json.Marshal(map[string]json.RawMessage{"encrypted": state.Encrypted})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, _, err := decryptConfig(data, key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt crypto state: %s", err)
+	}
+
+	decrypted := &CryptoState{}
+	if err := json.Unmarshal(plaintext, decrypted); err != nil {
+		return nil, fmt.Errorf("Could not decode crypto state: %s", err)
+	}
+
+	return decrypted, nil
+}
+
+func (b *Bot) olmPickleKey() string {
+	if b.pickleKey == "" {
+		return defaultPickleKey
+	}
+	return b.pickleKey
+}
+
+// Save the bot's encryption state to its crypto store, if it has one. b.lock must not be
+// held, it is held while saving so that the sessions are not used at the same time.
+func (b *Bot) saveCryptoState() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.cryptoStore == nil {
+		return nil
+	}
+
+	state := &CryptoState{
+		OutboundGroupSessions: b.groupSessions,
+		InboundGroupSessions:  b.inboundGroupSessions,
+		SenderClaimedKeys:     b.senderClaimedKeys,
+		OlmSessions:           map[string][]string{},
+		OlmSessionsKeyed:      b.pickleKey != "",
+		SharedDevices:         b.shookDevices,
+		Devices:               b.devices,
+		DeviceKeys:            b.deviceKeyCache,
+		DeviceListToken:       b.deviceListToken,
+		CrossSigning:          b.crossSigningKeys,
+		KeyBackup:             b.keyBackup,
+		BackedUpSessions:      b.backedUpSessions,
+		MessageIndexes:        b.messageIndexes,
+	}
+
+	for senderKey, sessions := range b.olmSessions {
+		for _, session := range sessions {
+			state.OlmSessions[senderKey] = append(state.OlmSessions[senderKey], session.Pickle(b.olmPickleKey()))
+		}
+	}
+
+	if b.pickleKey != "" {
+		var err error
+		if state, err = b.encryptCryptoState(state); err != nil {
+			return fmt.Errorf("Could not encrypt crypto state: %s", err)
+		}
+	}
+
+	if err := b.cryptoStore.SaveCryptoState(b.UserId, b.DeviceId, state); err != nil {
+		return fmt.Errorf("Could not save crypto state: %s", err)
+	}
+
+	b.messageIndexesChanged = false
+	return nil
+}
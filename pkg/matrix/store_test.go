@@ -0,0 +1,98 @@
+package matrix
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justinbarrick/go-matrix/pkg/megolm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCryptoStoreRestoresSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := FileCryptoStore(filepath.Join(dir, "crypto.json"))
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	assert.Nil(t, bot.SetCryptoStore(store))
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	inbound, err := megolm.NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	bot.groupSessions["!room:example.org"] = outbound
+	bot.addInboundGroupSession("!room:example.org", "senderkey", "sendered", inbound)
+	bot.shookDevices["!room:example.org"] = map[string]bool{deviceKey("@alice:example.org", "ALICE"): true}
+	outbound.Encrypt("advance the ratchet")
+	bot.recordMessageIndex("session", 0, "$event")
+	assert.Nil(t, bot.saveCryptoState())
+	assert.False(t, bot.messageIndexesChanged)
+
+	restored, err := NewBot("example.org")
+	assert.Nil(t, err)
+	assert.Nil(t, restored.SetCryptoStore(store))
+
+	session := restored.groupSessions["!room:example.org"]
+	assert.NotNil(t, session)
+	assert.Equal(t, outbound.GetSessionID(), session.GetSessionID())
+	assert.Equal(t, uint32(1), session.MessageIndex())
+	assert.True(t, restored.shookDevices["!room:example.org"][deviceKey("@alice:example.org", "ALICE")])
+	assert.Equal(t, "$event", restored.messageIndexes["session"][0])
+
+	_, ciphertext := session.Encrypt("after restart")
+	key := groupSessionKey("!room:example.org", "senderkey", outbound.GetSessionID())
+	plaintext, _, err := restored.inboundGroupSessions[key].Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "after restart", plaintext)
+	assert.Equal(t, "sendered", restored.senderClaimedKeys[key])
+}
+
+func TestFileCryptoStoreEncryptsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "crypto.json")
+
+	bot, err := NewBot("example.org")
+	assert.Nil(t, err)
+	bot.pickleKey = "config key"
+	assert.Nil(t, bot.SetCryptoStore(FileCryptoStore(path)))
+
+	outbound, err := megolm.NewOutboundSession()
+	assert.Nil(t, err)
+	bot.groupSessions["!room:example.org"] = outbound
+	bot.keyBackup = &KeyBackup{Version: "1", PrivateKey: []byte("backup-private-key")}
+	assert.Nil(t, bot.saveCryptoState())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(data), outbound.GetSessionID()))
+	assert.False(t, strings.Contains(string(data), base64.StdEncoding.EncodeToString(bot.keyBackup.PrivateKey)))
+
+	restored, err := NewBot("example.org")
+	assert.Nil(t, err)
+	assert.NotNil(t, restored.SetCryptoStore(FileCryptoStore(path)))
+
+	restored.pickleKey = "wrong key"
+	assert.NotNil(t, restored.SetCryptoStore(FileCryptoStore(path)))
+
+	restored.pickleKey = "config key"
+	assert.Nil(t, restored.SetCryptoStore(FileCryptoStore(path)))
+	assert.Equal(t, outbound.GetSessionID(), restored.groupSessions["!room:example.org"].GetSessionID())
+	assert.Equal(t, []byte("backup-private-key"), restored.keyBackup.PrivateKey)
+}
+
+func TestFileCryptoStoreMissingFile(t *testing.T) {
+	state, err := FileCryptoStore("/nonexistent/crypto.json").LoadCryptoState("@bot:example.org", "BOTDEVICE")
+	assert.Nil(t, err)
+	assert.Empty(t, state.OutboundGroupSessions)
+}
@@ -0,0 +1,360 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	"github.com/justinbarrick/go-matrix/pkg/client/room_participation"
+)
+
+const (
+	// How long the server should hold a /sync request open waiting for events.
+	syncTimeout = 30 * time.Second
+	// Bounds for the backoff between failed /sync requests.
+	syncMinBackoff = 1 * time.Second
+	syncMaxBackoff = 2 * time.Minute
+)
+
+// Where in a sync response an event was delivered.
+type EventKind string
+
+const (
+	TimelineEvent    EventKind = "timeline"
+	StateEvent       EventKind = "state"
+	EphemeralEvent   EventKind = "ephemeral"
+	AccountDataEvent EventKind = "account_data"
+	PresenceEvent    EventKind = "presence"
+	ToDeviceEvent    EventKind = "to_device"
+	InviteEvent      EventKind = "invite"
+)
+
+// Registering a handler for AnyEvent will receive every event that is dispatched.
+const AnyEvent = "*"
+
+// An event received from the server over /sync.
+type Event struct {
+	Type           string                 `json:"type"`
+	EventId        string                 `json:"event_id,omitempty"`
+	RoomId         string                 `json:"room_id,omitempty"`
+	Sender         string                 `json:"sender,omitempty"`
+	StateKey       *string                `json:"state_key,omitempty"`
+	OriginServerTs int64                  `json:"origin_server_ts,omitempty"`
+	Content        map[string]interface{} `json:"content"`
+	Unsigned       map[string]interface{} `json:"unsigned,omitempty"`
+	Redacts        string                 `json:"redacts,omitempty"`
+	Kind           EventKind              `json:"-"`
+	// Set when the event was decrypted before being dispatched.
+	Encryption *EncryptionInfo `json:"-"`
+}
+
+// A function that is called with each event of the type it was registered for.
+type EventHandler func(c context.Context, event *Event)
+
+// Persists the sync token so that a restarted bot resumes where it left off instead
+// of replaying events it has already handled.
+type SyncStore interface {
+	SaveNextBatch(userId, nextBatch string) error
+	LoadNextBatch(userId string) (string, error)
+}
+
+// A SyncStore that keeps the sync token in a file on disk.
+type FileSyncStore string
+
+func (f FileSyncStore) SaveNextBatch(userId, nextBatch string) error {
+	if err := os.MkdirAll(filepath.Dir(string(f)), os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(string(f), []byte(nextBatch), 0600)
+}
+
+func (f FileSyncStore) LoadNextBatch(userId string) (string, error) {
+	nextBatch, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(nextBatch)), err
+}
+
+type syncEvents struct {
+	Events []*Event `json:"events"`
+}
+
+type syncJoinedRoom struct {
+	State       syncEvents `json:"state"`
+	Timeline    syncEvents `json:"timeline"`
+	Ephemeral   syncEvents `json:"ephemeral"`
+	AccountData syncEvents `json:"account_data"`
+}
+
+type syncInvitedRoom struct {
+	InviteState syncEvents `json:"invite_state"`
+}
+
+type syncLeftRoom struct {
+	State    syncEvents `json:"state"`
+	Timeline syncEvents `json:"timeline"`
+}
+
+type syncDeviceLists struct {
+	Changed []string `json:"changed"`
+	Left    []string `json:"left"`
+}
+
+type syncResponse struct {
+	NextBatch   string          `json:"next_batch"`
+	AccountData syncEvents      `json:"account_data"`
+	Presence    syncEvents      `json:"presence"`
+	ToDevice    syncEvents      `json:"to_device"`
+	DeviceLists syncDeviceLists `json:"device_lists"`
+	Rooms       struct {
+		Join   map[string]syncJoinedRoom  `json:"join"`
+		Invite map[string]syncInvitedRoom `json:"invite"`
+		Leave  map[string]syncLeftRoom    `json:"leave"`
+	} `json:"rooms"`
+}
+
+// The generated sync models drop the event_id, sender and origin_server_ts of
+// timeline events, so sync responses are decoded into our own types instead.
+type syncReader struct{}
+
+func (s syncReader) ReadResponse(response runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+	if response.Code() != 200 {
+		return nil, runtime.NewAPIError("unknown error", response, response.Code())
+	}
+
+	result := &syncResponse{}
+	if err := json.NewDecoder(response.Body()).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Register a handler to be called for every event of eventType received by Sync.
+// Use AnyEvent to receive every event.
+func (b *Bot) On(eventType string, handler EventHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+// Register a function to be called whenever a /sync request fails and is retried.
+func (b *Bot) OnSyncError(handler func(err error)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.syncErrors = handler
+}
+
+// Set the store used to persist the sync token between runs.
+func (b *Bot) SetSyncStore(store SyncStore) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.syncStore = store
+}
+
+func (b *Bot) syncError(err error) {
+	b.lock.Lock()
+	handler := b.syncErrors
+	b.lock.Unlock()
+
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// Handlers are called without holding the lock so that they can use the bot.
+func (b *Bot) dispatch(c context.Context, event *Event) {
+	b.lock.Lock()
+	handlers := append(append([]EventHandler{}, b.handlers[event.Type]...), b.handlers[AnyEvent]...)
+	b.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(c, event)
+	}
+}
+
+func (b *Bot) dispatchAll(c context.Context, roomId string, kind EventKind, events []*Event) {
+	for _, event := range events {
+		if roomId != "" {
+			event.RoomId = roomId
+		}
+
+		event.Kind = kind
+
+		if kind == ToDeviceEvent || kind == TimelineEvent {
+			b.decryptSyncEvent(c, event)
+		}
+
+		if kind == StateEvent || kind == TimelineEvent {
+			b.handleRoomStateEvent(kind, event)
+		}
+
+		if kind == ToDeviceEvent && strings.HasPrefix(event.Type, "m.key.verification.") {
+			b.handleVerificationEvent(c, event)
+		}
+
+		b.dispatch(c, event)
+	}
+}
+
+// Fetch a single batch of events from the server, dispatch them to the registered
+// handlers and save the sync token.
+func (b *Bot) SyncOnce(c context.Context) error {
+	b.lock.Lock()
+	since, syncStore, wasSynced := b.nextBatch, b.syncStore, b.deviceListsSynced
+	b.lock.Unlock()
+
+	if since == "" && syncStore != nil {
+		nextBatch, err := syncStore.LoadNextBatch(b.UserId)
+		if err != nil {
+			return fmt.Errorf("Could not load sync token: %s", err)
+		}
+		since = nextBatch
+	}
+
+	timeout := int64(syncTimeout / time.Millisecond)
+
+	params := room_participation.NewSyncParamsWithContext(c)
+	params.SetTimeout(&timeout)
+	params.SetRequestTimeout(2 * syncTimeout)
+	if since != "" {
+		params.SetSince(&since)
+	}
+
+	result, err := b.client.Transport.Submit(&runtime.ClientOperation{
+		ID:                 "sync",
+		Method:             "GET",
+		PathPattern:        "/_matrix/client/unstable/sync",
+		ProducesMediaTypes: []string{"application/json"},
+		ConsumesMediaTypes: []string{"application/json"},
+		Schemes:            []string{"https"},
+		Params:             params,
+		Reader:             syncReader{},
+		AuthInfo:           b,
+		Context:            c,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not sync: %w", err)
+	}
+
+	sync := result.(*syncResponse)
+
+	// Update the device lists first so that handlers sending encrypted messages share
+	// room keys with new devices.
+	b.handleDeviceLists(c, since, sync.NextBatch, sync.DeviceLists)
+
+	b.dispatchAll(c, "", ToDeviceEvent, sync.ToDevice.Events)
+	b.dispatchAll(c, "", AccountDataEvent, sync.AccountData.Events)
+	b.dispatchAll(c, "", PresenceEvent, sync.Presence.Events)
+
+	joined, left := []string{}, []string{}
+	for roomId := range sync.Rooms.Join {
+		joined = append(joined, roomId)
+	}
+	for roomId := range sync.Rooms.Leave {
+		left = append(left, roomId)
+	}
+	b.handleRoomMemberships(joined, left)
+
+	for roomId, room := range sync.Rooms.Join {
+		b.dispatchAll(c, roomId, StateEvent, room.State.Events)
+		b.dispatchAll(c, roomId, TimelineEvent, room.Timeline.Events)
+		b.dispatchAll(c, roomId, EphemeralEvent, room.Ephemeral.Events)
+		b.dispatchAll(c, roomId, AccountDataEvent, room.AccountData.Events)
+	}
+
+	for roomId, room := range sync.Rooms.Invite {
+		b.dispatchAll(c, roomId, InviteEvent, room.InviteState.Events)
+	}
+
+	for roomId, room := range sync.Rooms.Leave {
+		b.dispatchAll(c, roomId, StateEvent, room.State.Events)
+		b.dispatchAll(c, roomId, TimelineEvent, room.Timeline.Events)
+	}
+
+	b.lock.Lock()
+	messageIndexesChanged := b.messageIndexesChanged
+	b.lock.Unlock()
+
+	// Decrypting to-device events updates Olm sessions and may add room keys, leaving a
+	// room discards its outbound group session and decrypting room events records their
+	// message indexes.
+	deviceListsChanged := !wasSynced || len(sync.DeviceLists.Changed) > 0 || len(sync.DeviceLists.Left) > 0
+	roomKeysChanged := len(sync.ToDevice.Events) > 0 || deviceListsChanged
+	if roomKeysChanged || len(left) > 0 || messageIndexesChanged {
+		if err := b.saveCryptoState(); err != nil {
+			return err
+		}
+	}
+
+	// A failed backup is retried with the next room key, it should not hold up sync.
+	if roomKeysChanged {
+		if err := b.BackupRoomKeys(c); err != nil {
+			b.syncError(err)
+		}
+	}
+
+	b.lock.Lock()
+	b.nextBatch = sync.NextBatch
+	b.lock.Unlock()
+
+	if syncStore != nil {
+		if err := syncStore.SaveNextBatch(b.UserId, sync.NextBatch); err != nil {
+			return fmt.Errorf("Could not save sync token: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Long-poll the server for events and dispatch them to the registered handlers until
+// the context is cancelled. Failed requests are retried with exponential backoff.
+func (b *Bot) Sync(c context.Context) error {
+	backoff := syncMinBackoff
+
+	for {
+		err := b.SyncOnce(c)
+		if c.Err() != nil {
+			return c.Err()
+		}
+
+		if err == nil {
+			backoff = syncMinBackoff
+			continue
+		}
+
+		b.syncError(err)
+
+		if !waitSyncBackoff(c, &backoff) {
+			return c.Err()
+		}
+	}
+}
+
+// Wait before retrying a failed sync and double the next wait, up to syncMaxBackoff.
+// Returns false if c is done first.
+func waitSyncBackoff(c context.Context, backoff *time.Duration) bool {
+	select {
+	case <-c.Done():
+		return false
+	case <-time.After(*backoff):
+	}
+
+	*backoff *= 2
+	if *backoff > syncMaxBackoff {
+		*backoff = syncMaxBackoff
+	}
+	return true
+}
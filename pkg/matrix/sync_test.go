@@ -0,0 +1,135 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a bot that talks to the given test server.
+func newTestBot(t *testing.T, server *httptest.Server) *Bot {
+	serverUrl, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	bot, err := NewBot(serverUrl.Host)
+	assert.Nil(t, err)
+
+	bot.UserId = "@bot:example.org"
+	bot.DeviceId = "BOTDEVICE"
+	bot.AccessToken = "token"
+	bot.httpRuntime.Transport = server.Client().Transport
+	return &bot
+}
+
+const testSyncResponse = `{
+	"next_batch": "s2",
+	"to_device": {"events": [{"type": "m.dummy", "sender": "@alice:example.org", "content": {}}]},
+	"rooms": {
+		"join": {
+			"!room:example.org": {
+				"state": {"events": [{"type": "m.room.name", "state_key": "", "event_id": "$1", "sender": "@alice:example.org", "content": {"name": "ops"}}]},
+				"timeline": {"events": [{"type": "m.room.message", "event_id": "$2", "sender": "@alice:example.org", "origin_server_ts": 1234, "content": {"msgtype": "m.text", "body": "hi"}}]},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": []}}]}
+			}
+		},
+		"invite": {
+			"!invite:example.org": {
+				"invite_state": {"events": [{"type": "m.room.member", "state_key": "@bot:example.org", "sender": "@alice:example.org", "content": {"membership": "invite"}}]}
+			}
+		}
+	}
+}`
+
+func TestSyncOnceDispatchesEvents(t *testing.T) {
+	since := []string{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/unstable/sync", r.URL.Path)
+		since = append(since, r.URL.Query().Get("since"))
+		fmt.Fprint(w, testSyncResponse)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	messages := []*Event{}
+	bot.On("m.room.message", func(c context.Context, event *Event) {
+		messages = append(messages, event)
+	})
+
+	all := map[EventKind]int{}
+	bot.On(AnyEvent, func(c context.Context, event *Event) {
+		all[event.Kind]++
+	})
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	assert.Equal(t, []string{"", "s2"}, since)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "$2", messages[0].EventId)
+	assert.Equal(t, "@alice:example.org", messages[0].Sender)
+	assert.Equal(t, "!room:example.org", messages[0].RoomId)
+	assert.Equal(t, int64(1234), messages[0].OriginServerTs)
+	assert.Equal(t, "hi", messages[0].Content["body"])
+	assert.Equal(t, map[EventKind]int{
+		ToDeviceEvent:  2,
+		StateEvent:     2,
+		TimelineEvent:  2,
+		EphemeralEvent: 2,
+		InviteEvent:    2,
+	}, all)
+}
+
+func TestSyncOnceUsesSyncStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-matrix")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := FileSyncStore(filepath.Join(dir, "next_batch"))
+	assert.Nil(t, store.SaveNextBatch("@bot:example.org", "s1"))
+
+	since := ""
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since = r.URL.Query().Get("since")
+		fmt.Fprint(w, testSyncResponse)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.SetSyncStore(store)
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+	assert.Equal(t, "s1", since)
+
+	nextBatch, err := store.LoadNextBatch("@bot:example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, "s2", nextBatch)
+}
+
+func TestSyncRetriesUntilCancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"errcode": "M_UNKNOWN"}`, 500)
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	c, cancel := context.WithCancel(context.TODO())
+	bot.OnSyncError(func(err error) {
+		cancel()
+	})
+
+	assert.Equal(t, context.Canceled, bot.Sync(c))
+	assert.Equal(t, 1, requests)
+}
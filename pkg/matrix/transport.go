@@ -0,0 +1,164 @@
+package matrix
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+)
+
+// Settings for the HTTP connection to the homeserver. They are saved with the bot.
+type TransportOptions struct {
+	// A PEM file of CA certificates to trust in addition to the system ones, for
+	// servers with certificates from an internal CA.
+	CAFile string `json:"caFile,omitempty"`
+	// PEM files of a client certificate and its key to present to the server.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// The URL of a proxy to send requests through. If it is empty HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY are used.
+	Proxy string `json:"proxy,omitempty"`
+	// How long to wait to connect to the server, including the TLS handshake.
+	ConnectTimeout time.Duration `json:"connectTimeout,omitempty"`
+	// How long to wait for each attempt at a request. Long polling requests such as
+	// /sync wait this long on top of their own timeout. 0 waits forever.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// Set the bot's transport options and reconnect to the homeserver with them.
+func (b *Bot) SetTransportOptions(options *TransportOptions) error {
+	transport, err := newTransport(options)
+	if err != nil {
+		return err
+	}
+
+	httpRuntime, err := newRuntime(b.Server, transport)
+	if err != nil {
+		return err
+	}
+
+	b.Transport = options
+	b.httpRuntime = httpRuntime
+	b.client = clientFor(httpRuntime)
+	return nil
+}
+
+// Build the http.RoundTripper for requests to the homeserver.
+func newTransport(options *TransportOptions) (http.RoundTripper, error) {
+	if options == nil {
+		return NewRetryTransport(&ochttp.Transport{}), nil
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+
+	if options.Proxy != "" {
+		proxy, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL %s: %s", options.Proxy, err)
+		}
+		base.Proxy = http.ProxyURL(proxy)
+	}
+
+	if options.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   options.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		base.DialContext = dialer.DialContext
+		base.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+
+	if options.CAFile != "" || options.CertFile != "" || options.KeyFile != "" {
+		tlsConfig, err := options.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		base.TLSClientConfig = tlsConfig
+	}
+
+	var transport http.RoundTripper = &ochttp.Transport{Base: base}
+	if options.Timeout > 0 {
+		transport = timeoutTransport{transport, options.Timeout}
+	}
+
+	return NewRetryTransport(transport), nil
+}
+
+// Load the CA bundle and client certificate.
+func (options *TransportOptions) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %s", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// An http.RoundTripper that gives up on requests that take longer than timeout to
+// complete. It sits under the RetryTransport, so each attempt gets the full timeout.
+type timeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := t.timeout
+	// Long polling requests say how long the server may hold them in milliseconds.
+	if ms, err := strconv.ParseInt(req.URL.Query().Get("timeout"), 10, 64); err == nil && ms > 0 {
+		timeout += time.Duration(ms) * time.Millisecond
+	}
+
+	c, cancel := context.WithTimeout(req.Context(), timeout)
+
+	resp, err := t.transport.RoundTrip(req.WithContext(c))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// A response body that releases its request's context when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
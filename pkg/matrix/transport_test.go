@@ -0,0 +1,83 @@
+package matrix
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, "/matrix/_matrix/client/unstable/sync", r.URL.Path)
+		fmt.Fprint(w, `{"next_batch": "s1"}`)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600))
+
+	bot, err := NewBot(server.URL + "/matrix")
+	assert.Nil(t, err)
+	bot.AccessToken = "token"
+
+	// The server's certificate is not trusted by default.
+	bot.httpRuntime.Transport.(*RetryTransport).MaxRetries = 0
+	assert.NotNil(t, bot.SyncOnce(context.TODO()))
+
+	assert.Nil(t, bot.SetTransportOptions(&TransportOptions{CAFile: caFile}))
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+
+	// The options are saved with the bot.
+	data, err := encodeBot(bot, "")
+	assert.Nil(t, err)
+	loaded, err := decodeBot(data, "")
+	assert.Nil(t, err)
+	assert.Equal(t, caFile, loaded.Transport.CAFile)
+	assert.Nil(t, loaded.SyncOnce(context.TODO()))
+
+	_, err = newTransport(&TransportOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.NotNil(t, err)
+}
+
+func TestTransportTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/sync":
+			// Long polls may take their own timeout longer.
+			assert.Equal(t, "30000", r.URL.Query().Get("timeout"))
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `{"next_batch": "s1"}`)
+		default:
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	bot, err := NewBot(server.URL)
+	assert.Nil(t, err)
+	bot.AccessToken = "token"
+
+	assert.Nil(t, bot.SetTransportOptions(&TransportOptions{Timeout: 50 * time.Millisecond}))
+	bot.httpRuntime.Transport.(*RetryTransport).MaxRetries = 0
+
+	err = bot.doJSON(context.TODO(), "GET", "/room_keys/version", nil, nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	assert.Nil(t, bot.SyncOnce(context.TODO()))
+}
@@ -0,0 +1,256 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Stage types of user-interactive authentication.
+const (
+	AuthPassword          = "m.login.password"
+	AuthDummy             = "m.login.dummy"
+	AuthRegistrationToken = "m.login.registration_token"
+	AuthTerms             = "m.login.terms"
+	AuthEmailIdentity     = "m.login.email.identity"
+)
+
+// The state of a user-interactive authentication session, from the 401 response to a
+// request that needs it.
+type AuthSession struct {
+	// The ID the server gave the session, sent back with every stage.
+	Session string
+	// The stages of each flow that the server accepts.
+	Flows [][]string
+	// Parameters of each stage, keyed by stage type.
+	Params map[string]interface{}
+	// The stages that have been completed so far.
+	Completed []string
+}
+
+// Completes a stage of user-interactive authentication, returning the fields of the auth
+// dict for the stage, which may be nil. The type and session are filled in.
+type AuthStageHandler func(c context.Context, session *AuthSession) (map[string]interface{}, error)
+
+// Handlers for the stages the bot can complete, keyed by stage type. m.login.dummy is
+// always handled.
+type AuthStages map[string]AuthStageHandler
+
+// Authenticate with the password of userId.
+func PasswordAuth(userId, password string) AuthStageHandler {
+	return func(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"identifier": map[string]string{
+				"type": "m.id.user",
+				"user": userId,
+			},
+			"password": password,
+		}, nil
+	}
+}
+
+// Complete a stage that only needs to be attempted, such as m.login.dummy.
+func DummyAuth(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+// Register with a registration token given out by the server's admin.
+func RegistrationTokenAuth(token string) AuthStageHandler {
+	return func(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"token": token,
+		}, nil
+	}
+}
+
+// Accept the server's terms of service if accept returns true. policies is keyed by
+// policy name, each has a version and the name and url of each of its translations.
+func TermsAuth(accept func(policies map[string]interface{}) bool) AuthStageHandler {
+	return func(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+		params, _ := session.Params[AuthTerms].(map[string]interface{})
+		policies, _ := params["policies"].(map[string]interface{})
+
+		if !accept(policies) {
+			return nil, fmt.Errorf("The terms of service were not accepted")
+		}
+
+		return map[string]interface{}{}, nil
+	}
+}
+
+// Authenticate with an email address that has been validated. credentials is called
+// once the stage is reached and returns the sid and client secret of a token request,
+// such as one made with RequestRegistrationEmailToken, after the user has followed the
+// link in the email.
+func EmailIdentityAuth(credentials func(c context.Context) (sid, clientSecret string, err error)) AuthStageHandler {
+	return func(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+		sid, clientSecret, err := credentials(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"threepid_creds": map[string]string{
+				"sid":           sid,
+				"client_secret": clientSecret,
+			},
+		}, nil
+	}
+}
+
+// Ask the server to email a validation link to an address, to register with it. Returns
+// the sid to authenticate with once the link has been followed.
+func (b *Bot) RequestRegistrationEmailToken(c context.Context, email, clientSecret string, sendAttempt int) (string, error) {
+	result := struct {
+		Sid string `json:"sid"`
+	}{}
+
+	err := b.doUnauthenticatedJSON(c, "POST", "/register/email/requestToken", map[string]interface{}{
+		"email":         email,
+		"client_secret": clientSecret,
+		"send_attempt":  sendAttempt,
+	}, &result)
+	if err != nil {
+		return "", fmt.Errorf("Could not request email validation: %w", err)
+	}
+
+	return result.Sid, nil
+}
+
+// Parse the user-interactive authentication session from the error a request failed
+// with, if the server wants us to authenticate.
+func authSession(err error) (*AuthSession, bool) {
+	var matrixErr *Error
+	if !errors.As(err, &matrixErr) || matrixErr.StatusCode != http.StatusUnauthorized {
+		return nil, false
+	}
+
+	flows, ok := matrixErr.body["flows"].([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	session := &AuthSession{
+		Session: contentString(matrixErr.body, "session"),
+		Params:  map[string]interface{}{},
+	}
+
+	for _, flow := range flows {
+		flow, _ := flow.(map[string]interface{})
+		stages, _ := flow["stages"].([]interface{})
+		session.Flows = append(session.Flows, contentStrings(stages))
+	}
+
+	if params, ok := matrixErr.body["params"].(map[string]interface{}); ok {
+		session.Params = params
+	}
+
+	completed, _ := matrixErr.body["completed"].([]interface{})
+	session.Completed = contentStrings(completed)
+
+	return session, true
+}
+
+func contentStrings(values []interface{}) []string {
+	strs := []string{}
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// Whether a stage has been completed.
+func (session *AuthSession) completed(stage string) bool {
+	for _, completed := range session.Completed {
+		if completed == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick the next stage of the first flow that we can complete every remaining stage of.
+func (session *AuthSession) nextStage(stages AuthStages) (string, error) {
+	for _, flow := range session.Flows {
+		next := ""
+		supported := true
+
+		for _, stage := range flow {
+			if session.completed(stage) {
+				continue
+			}
+
+			if _, ok := stages[stage]; !ok {
+				supported = false
+				break
+			}
+
+			if next == "" {
+				next = stage
+			}
+		}
+
+		if supported && next != "" {
+			return next, nil
+		}
+	}
+
+	flows := []string{}
+	for _, flow := range session.Flows {
+		flows = append(flows, strings.Join(flow, ", "))
+	}
+
+	return "", fmt.Errorf("No supported authentication flow, the server accepts: [%s]", strings.Join(flows, "], ["))
+}
+
+// Make a request that may need user-interactive authentication, completing the stages
+// the server asks for with stages. request is called with the auth dict to send, nil
+// the first time, and returns the error the request failed with.
+func (b *Bot) authenticate(c context.Context, stages AuthStages, request func(auth map[string]interface{}) error) error {
+	if _, ok := stages[AuthDummy]; !ok {
+		withDummy := AuthStages{AuthDummy: DummyAuth}
+		for stage, handler := range stages {
+			withDummy[stage] = handler
+		}
+		stages = withDummy
+	}
+
+	err := request(nil)
+	attempted := ""
+
+	for {
+		session, ok := authSession(err)
+		if !ok {
+			return err
+		}
+
+		// The server says why the last stage failed, or left it incomplete.
+		if attempted != "" && (ErrCode(err) != "" || !session.completed(attempted)) {
+			return fmt.Errorf("Could not complete %s: %w", attempted, err)
+		}
+
+		attempted, err = session.nextStage(stages)
+		if err != nil {
+			return err
+		}
+
+		var auth map[string]interface{}
+		if auth, err = stages[attempted](c, session); err != nil {
+			return fmt.Errorf("Could not complete %s: %w", attempted, err)
+		}
+
+		if auth == nil {
+			auth = map[string]interface{}{}
+		}
+		auth["type"] = attempted
+		if session.Session != "" {
+			auth["session"] = session.Session
+		}
+
+		err = request(auth)
+	}
+}
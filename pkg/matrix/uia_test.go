@@ -0,0 +1,125 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthFlows = `"session": "abc",
+	"flows": [
+		{"stages": ["m.login.email.identity"]},
+		{"stages": ["m.login.registration_token", "m.login.terms"]}
+	],
+	"params": {
+		"m.login.terms": {
+			"policies": {
+				"privacy_policy": {"version": "1.0", "en": {"name": "Privacy Policy", "url": "https://example.org/privacy"}}
+			}
+		}
+	}`
+
+func TestRegisterWithAuth(t *testing.T) {
+	auths := []map[string]interface{}{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/unstable/register":
+			body := map[string]interface{}{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "bot", body["username"])
+
+			auth, _ := body["auth"].(map[string]interface{})
+			auths = append(auths, auth)
+
+			switch len(auths) {
+			case 1:
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, `{%s}`, testAuthFlows)
+			case 2:
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, `{%s, "completed": ["m.login.registration_token"]}`, testAuthFlows)
+			default:
+				fmt.Fprint(w, `{"user_id": "@bot:example.org", "access_token": "token", "device_id": "BOTDEVICE"}`)
+			}
+		case "/_matrix/client/unstable/keys/upload":
+			fmt.Fprint(w, `{"one_time_key_counts": {}}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+	bot.UserId = ""
+
+	policies := map[string]interface{}{}
+	err := bot.RegisterWithAuth(context.TODO(), "bot", "password", AuthStages{
+		AuthRegistrationToken: RegistrationTokenAuth("token123"),
+		AuthTerms: TermsAuth(func(p map[string]interface{}) bool {
+			policies = p
+			return true
+		}),
+	})
+	assert.Nil(t, err)
+
+	// The flow without email was used, one stage at a time.
+	assert.Equal(t, 3, len(auths))
+	assert.Nil(t, auths[0])
+	assert.Equal(t, map[string]interface{}{
+		"type":    "m.login.registration_token",
+		"session": "abc",
+		"token":   "token123",
+	}, auths[1])
+	assert.Equal(t, map[string]interface{}{
+		"type":    "m.login.terms",
+		"session": "abc",
+	}, auths[2])
+	assert.Contains(t, policies, "privacy_policy")
+
+	assert.Equal(t, "@bot:example.org", bot.UserId)
+	assert.Equal(t, "BOTDEVICE", bot.DeviceId)
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		body := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+
+		w.WriteHeader(http.StatusUnauthorized)
+		if body["auth"] == nil {
+			fmt.Fprint(w, `{"session": "abc", "flows": [{"stages": ["m.login.password"]}]}`)
+		} else {
+			fmt.Fprint(w, `{"errcode": "M_FORBIDDEN", "error": "Invalid password", "session": "abc", "flows": [{"stages": ["m.login.password"]}]}`)
+		}
+	}))
+	defer server.Close()
+
+	bot := newTestBot(t, server)
+
+	// The server's response to a failed stage is returned.
+	err := bot.ChangePassword(context.TODO(), "new", false, AuthStages{
+		AuthPassword: PasswordAuth(bot.UserId, "wrong"),
+	})
+	assert.Equal(t, "M_FORBIDDEN", ErrCode(err))
+	assert.Equal(t, "Could not change password: Could not complete m.login.password: [401] M_FORBIDDEN: Invalid password", err.Error())
+
+	// Handlers that have no fields to add may return a nil auth dict.
+	err = bot.ChangePassword(context.TODO(), "new", false, AuthStages{
+		AuthPassword: func(c context.Context, session *AuthSession) (map[string]interface{}, error) {
+			return nil, nil
+		},
+	})
+	assert.Equal(t, "M_FORBIDDEN", ErrCode(err))
+
+	// Flows with stages that we have no handler for are not attempted.
+	err = bot.DeleteDevice(context.TODO(), "OTHERDEVICE", nil)
+	assert.Equal(t, "Could not delete device OTHERDEVICE: No supported authentication flow, the server accepts: [m.login.password]", err.Error())
+}
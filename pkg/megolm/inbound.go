@@ -0,0 +1,147 @@
+package megolm
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+)
+
+// A session used to decrypt messages that other devices sent to a room.
+type InboundSession struct {
+	// The earliest ratchet state we know of, used to decrypt older messages.
+	initial ratchet
+	// The latest ratchet state we have advanced to, to avoid re-deriving it.
+	latest     ratchet
+	signingKey ed25519.PublicKey
+	// True when the session was received as a signed session key rather than
+	// imported from an unsigned export.
+	verified bool
+}
+
+// Create an inbound session from the session_key of an m.room_key event.
+func NewInboundSession(sessionKey string) (*InboundSession, error) {
+	data, err := decode(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode session key: %s", err)
+	}
+
+	signedLength := 1 + 4 + ratchetLength + publicKeyLength
+	if len(data) != signedLength+signatureLength || data[0] != sessionKeyVersion {
+		return nil, fmt.Errorf("Invalid session key")
+	}
+
+	signingKey := ed25519.PublicKey(data[1+4+ratchetLength : signedLength])
+	if !ed25519.Verify(signingKey, data[:signedLength], data[signedLength:]) {
+		return nil, fmt.Errorf("Invalid session key signature")
+	}
+
+	session := newInboundSession(data)
+	session.verified = true
+	return session, nil
+}
+
+// Create an inbound session from a session exported with Export, as used in key
+// exports, key backups and forwarded room keys.
+func ImportInboundSession(exported string) (*InboundSession, error) {
+	data, err := decode(exported)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode exported session: %s", err)
+	}
+
+	if len(data) != 1+4+ratchetLength+publicKeyLength || data[0] != exportVersion {
+		return nil, fmt.Errorf("Invalid exported session")
+	}
+
+	return newInboundSession(data), nil
+}
+
+func newInboundSession(data []byte) *InboundSession {
+	counter := binary.BigEndian.Uint32(data[1:5])
+	r := ratchetFromBytes(data[5:5+ratchetLength], counter)
+
+	signingKey := make(ed25519.PublicKey, publicKeyLength)
+	copy(signingKey, data[5+ratchetLength:])
+
+	return &InboundSession{
+		initial:    r,
+		latest:     r,
+		signingKey: signingKey,
+	}
+}
+
+// The session ID, which is the session's public signing key.
+func (s *InboundSession) GetSessionID() string {
+	return encode(s.signingKey)
+}
+
+// The first message index that this session can decrypt.
+func (s *InboundSession) FirstKnownIndex() uint32 {
+	return s.initial.counter
+}
+
+// Whether the session was received with a signed session key.
+func (s *InboundSession) Verified() bool {
+	return s.verified
+}
+
+func (s *InboundSession) ratchetAt(index uint32) (ratchet, error) {
+	if index < s.initial.counter {
+		return ratchet{}, fmt.Errorf("Unknown message index %d, first known index is %d", index, s.initial.counter)
+	}
+
+	if s.latest.counter <= index {
+		s.latest.advanceTo(index)
+		return s.latest, nil
+	}
+
+	r := s.initial
+	r.advanceTo(index)
+	return r, nil
+}
+
+// Decrypt a message, returning the plaintext and the message index. Callers should
+// track the indexes they have seen to detect replayed messages.
+func (s *InboundSession) Decrypt(encoded string) (string, uint32, error) {
+	msg, err := decodeMessage(encoded)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !ed25519.Verify(s.signingKey, append(append([]byte{}, msg.payload...), msg.mac...), msg.signature) {
+		return "", 0, fmt.Errorf("Invalid message signature")
+	}
+
+	r, err := s.ratchetAt(msg.index)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !hmac.Equal(r.mac(msg.payload), msg.mac) {
+		return "", 0, fmt.Errorf("Invalid message MAC")
+	}
+
+	plaintext, err := r.decrypt(msg.ciphertext)
+	if err != nil {
+		return "", 0, err
+	}
+
+	s.verified = true
+	return string(plaintext), msg.index, nil
+}
+
+// Export the session at the given message index so that it can be imported with
+// ImportInboundSession.
+func (s *InboundSession) Export(index uint32) (string, error) {
+	r, err := s.ratchetAt(index)
+	if err != nil {
+		return "", err
+	}
+
+	data := []byte{exportVersion}
+	data = append(data, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(data[1:], r.counter)
+	data = append(data, r.bytes()...)
+	data = append(data, s.signingKey...)
+	return encode(data), nil
+}
@@ -0,0 +1,255 @@
+// Package megolm implements the Megolm group ratchet used to encrypt Matrix room events
+// (m.megolm.v1.aes-sha2).
+//
+// libolm-go only wraps outbound group sessions, so the ratchet is implemented here to
+// support receiving, persisting and exporting room keys. The wire formats are the same
+// as libolm's, and the tests check them against libolm's own test vectors, so sessions
+// can be shared with any other Matrix client.
+package megolm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ratchetParts      = 4
+	ratchetPartLength = 32
+	ratchetLength     = ratchetParts * ratchetPartLength
+
+	messageVersion    = 3
+	sessionKeyVersion = 2
+	exportVersion     = 1
+
+	macLength       = 8
+	signatureLength = 64
+	publicKeyLength = 32
+
+	indexTag      = 0x08
+	ciphertextTag = 0x12
+)
+
+var keysInfo = []byte("MEGOLM_KEYS")
+
+// The ratchet state at a given message index.
+type ratchet struct {
+	data    [ratchetParts][ratchetPartLength]byte
+	counter uint32
+}
+
+func ratchetFromBytes(data []byte, counter uint32) ratchet {
+	r := ratchet{counter: counter}
+	for i := 0; i < ratchetParts; i++ {
+		copy(r.data[i][:], data[i*ratchetPartLength:])
+	}
+	return r
+}
+
+func (r *ratchet) bytes() []byte {
+	data := make([]byte, 0, ratchetLength)
+	for i := 0; i < ratchetParts; i++ {
+		data = append(data, r.data[i][:]...)
+	}
+	return data
+}
+
+func (r *ratchet) rehash(from, to int) {
+	mac := hmac.New(sha256.New, r.data[from][:])
+	mac.Write([]byte{byte(to)})
+	copy(r.data[to][:], mac.Sum(nil))
+}
+
+// Advance the ratchet by one message.
+func (r *ratchet) advance() {
+	r.counter++
+
+	mask := uint32(0x00ffffff)
+	h := 0
+	for h < ratchetParts {
+		if r.counter&mask == 0 {
+			break
+		}
+		h++
+		mask >>= 8
+	}
+
+	for i := ratchetParts - 1; i >= h; i-- {
+		r.rehash(h, i)
+	}
+}
+
+// Advance the ratchet to the given message index without computing every
+// intermediate state.
+func (r *ratchet) advanceTo(index uint32) {
+	for j := 0; j < ratchetParts; j++ {
+		shift := uint((ratchetParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+
+		steps := ((index >> shift) - (r.counter >> shift)) & 0xff
+		if steps == 0 {
+			if index < r.counter {
+				steps = 0x100
+			} else {
+				continue
+			}
+		}
+
+		for ; steps > 1; steps-- {
+			r.rehash(j, j)
+		}
+
+		for k := ratchetParts - 1; k >= j; k-- {
+			r.rehash(j, k)
+		}
+
+		r.counter = index & mask
+	}
+}
+
+// Derive the AES key, HMAC key and AES IV for the current message.
+func (r *ratchet) keys() (aesKey, macKey, iv []byte) {
+	keys := make([]byte, 80)
+	io.ReadFull(hkdf.New(sha256.New, r.bytes(), nil, keysInfo), keys)
+	return keys[:32], keys[32:64], keys[64:80]
+}
+
+func (r *ratchet) encrypt(plaintext []byte) []byte {
+	aesKey, _, iv := r.keys()
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, _ := aes.NewCipher(aesKey)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return ciphertext
+}
+
+func (r *ratchet) decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length: %d", len(ciphertext))
+	}
+
+	aesKey, _, iv := r.keys()
+	block, _ := aes.NewCipher(aesKey)
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("Invalid padding")
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func (r *ratchet) mac(data []byte) []byte {
+	_, macKey, _ := r.keys()
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:macLength]
+}
+
+// Matrix uses unpadded base64 everywhere, but be lenient about padding on input.
+func encode(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+func decode(data string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+func putVarint(buf []byte, value uint64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	return append(buf, varint[:binary.PutUvarint(varint, value)]...)
+}
+
+// A decoded group message.
+type message struct {
+	index      uint32
+	ciphertext []byte
+	// Everything covered by the MAC.
+	payload   []byte
+	mac       []byte
+	signature []byte
+}
+
+func encodeMessage(index uint32, ciphertext []byte) []byte {
+	payload := []byte{messageVersion, indexTag}
+	payload = putVarint(payload, uint64(index))
+	payload = append(payload, ciphertextTag)
+	payload = putVarint(payload, uint64(len(ciphertext)))
+	return append(payload, ciphertext...)
+}
+
+func decodeMessage(encoded string) (*message, error) {
+	data, err := decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode message: %s", err)
+	}
+
+	if len(data) < 1+macLength+signatureLength {
+		return nil, fmt.Errorf("Message is too short")
+	}
+
+	if data[0] != messageVersion {
+		return nil, fmt.Errorf("Unsupported message version: %d", data[0])
+	}
+
+	payloadLength := len(data) - macLength - signatureLength
+	msg := &message{
+		payload:   data[:payloadLength],
+		mac:       data[payloadLength : payloadLength+macLength],
+		signature: data[payloadLength+macLength:],
+	}
+
+	hasIndex := false
+	fields := bytes.NewReader(data[1:payloadLength])
+	for fields.Len() > 0 {
+		tag, _ := fields.ReadByte()
+
+		switch tag & 0x7 {
+		case 0:
+			value, err := binary.ReadUvarint(fields)
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode message: %s", err)
+			}
+
+			if tag == indexTag {
+				msg.index = uint32(value)
+				hasIndex = true
+			}
+		case 2:
+			length, err := binary.ReadUvarint(fields)
+			if err != nil || length > uint64(fields.Len()) {
+				return nil, fmt.Errorf("Could not decode message: truncated field")
+			}
+
+			value := make([]byte, length)
+			fields.Read(value)
+
+			if tag == ciphertextTag {
+				msg.ciphertext = value
+			}
+		default:
+			return nil, fmt.Errorf("Could not decode message: unknown field type %d", tag)
+		}
+	}
+
+	if !hasIndex || msg.ciphertext == nil {
+		return nil, fmt.Errorf("Message is missing required fields")
+	}
+
+	return msg, nil
+}
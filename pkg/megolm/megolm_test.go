@@ -0,0 +1,208 @@
+package megolm
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// Known answers from libolm's group session tests. The outbound session is created
+// from the same random bytes as libolm's: the ratchet followed by the ed25519 seed.
+var (
+	libolmRandom = strings.Repeat("0123456789ABDEF0123456789ABCDEF", 6)
+
+	libolmSessionKey = "AgAAAAAwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMzQ1Njc4OUFCREVGM" +
+		"DEyMzQ1Njc4OUFCQ0RFRjAxMjM0NTY3ODlBQkRFRjAxMjM0NTY3ODlBQkNERUYwMTIzND" +
+		"U2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMw0bdg1BDq4Px/slBow06q8n/B9WBfw" +
+		"WYyNOB8DlUmXGGwrFmaSb9bR/eY8xgERrxmP07hFmD9uqA2p8PMHdnV5ysmgufE6oLZ5+" +
+		"8/mWQOW3VVTnDIlnwd8oHUYRuk8TCQ"
+
+	libolmMessage = "AwgAEhAcbh6UpbByoyZxufQ+h2B+8XHMjhR69G8F4+qjMaFlnIXusJZX3r8LnRORG9T3D" +
+		"XFdbVuvIWrLyRfm4i8QRbe8VPwGRFG57B1CtmxanuP8bHtnnYqlwPsD"
+
+	// olm_export_inbound_group_session of the session at index 0.
+	libolmExport = "AQAAAAAwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMzQ1Njc4OUFCREVGM" +
+		"DEyMzQ1Njc4OUFCQ0RFRjAxMjM0NTY3ODlBQkRFRjAxMjM0NTY3ODlBQkNERUYwMTIzND" +
+		"U2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMw0bdg1BDq4Px/slBow06q8n/B9WBfw" +
+		"WYyNOB8DlUmXG"
+)
+
+func TestLibolmOutboundSession(t *testing.T) {
+	outbound := &OutboundSession{
+		ratchet:    ratchetFromBytes([]byte(libolmRandom[:ratchetLength]), 0),
+		signingKey: ed25519.NewKeyFromSeed([]byte(libolmRandom[ratchetLength : ratchetLength+ed25519.SeedSize])),
+	}
+
+	assert.Equal(t, libolmSessionKey, outbound.GetSessionKey())
+
+	_, ciphertext := outbound.Encrypt("Message")
+	assert.Equal(t, libolmMessage, ciphertext)
+}
+
+func TestLibolmInboundSession(t *testing.T) {
+	inbound, err := NewInboundSession(libolmSessionKey)
+	assert.Nil(t, err)
+
+	plaintext, index, err := inbound.Decrypt(libolmMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, "Message", plaintext)
+	assert.Equal(t, uint32(0), index)
+
+	exported, err := inbound.Export(0)
+	assert.Nil(t, err)
+	assert.Equal(t, libolmExport, exported)
+
+	imported, err := ImportInboundSession(libolmExport)
+	assert.Nil(t, err)
+	assert.Equal(t, inbound.GetSessionID(), imported.GetSessionID())
+
+	plaintext, _, err = imported.Decrypt(libolmMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, "Message", plaintext)
+
+	// The same message with a bad signature, also from libolm's tests.
+	_, _, err = inbound.Decrypt(libolmMessage[:len(libolmMessage)-1] + "E")
+	assert.NotNil(t, err)
+}
+
+func TestRatchetAdvanceTo(t *testing.T) {
+	var tests = []struct {
+		start uint32
+		end   uint32
+	}{
+		{0, 1},
+		{0, 1000},
+		{0xfe, 0x102},
+		{0xfffe, 0x10003},
+		{0xfffffe, 0x1000001},
+		{0x12, 0x10000},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%x-%x", test.start, test.end), func(t *testing.T) {
+			sequential := ratchet{counter: test.start}
+			sequential.data[0][0] = 1
+			sequential.data[1][0] = 2
+			sequential.data[2][0] = 3
+			sequential.data[3][0] = 4
+
+			skipped := sequential
+
+			for sequential.counter < test.end {
+				sequential.advance()
+			}
+			skipped.advanceTo(test.end)
+
+			assert.Equal(t, sequential, skipped)
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	outbound, err := NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+	assert.Equal(t, outbound.GetSessionID(), inbound.GetSessionID())
+	assert.True(t, inbound.Verified())
+
+	messages := []string{}
+	for i := 0; i < 5; i++ {
+		_, ciphertext := outbound.Encrypt(fmt.Sprintf("message %d", i))
+		messages = append(messages, ciphertext)
+	}
+
+	assert.Equal(t, uint32(5), outbound.MessageIndex())
+
+	for _, i := range []int{3, 0, 4, 1} {
+		plaintext, index, err := inbound.Decrypt(messages[i])
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(i), index)
+		assert.Equal(t, fmt.Sprintf("message %d", i), plaintext)
+	}
+}
+
+func TestDecryptRejectsTamperedMessages(t *testing.T) {
+	outbound, err := NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	_, ciphertext := outbound.Encrypt("hello")
+	data, err := decode(ciphertext)
+	assert.Nil(t, err)
+
+	data[len(data)-signatureLength-macLength-1] ^= 1
+	_, _, err = inbound.Decrypt(encode(data))
+	assert.NotNil(t, err)
+
+	other, err := NewOutboundSession()
+	assert.Nil(t, err)
+
+	_, ciphertext = other.Encrypt("hello")
+	_, _, err = inbound.Decrypt(ciphertext)
+	assert.NotNil(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	outbound, err := NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	_, first := outbound.Encrypt("first")
+	_, second := outbound.Encrypt("second")
+
+	exported, err := inbound.Export(1)
+	assert.Nil(t, err)
+
+	imported, err := ImportInboundSession(exported)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), imported.FirstKnownIndex())
+	assert.False(t, imported.Verified())
+
+	_, _, err = imported.Decrypt(first)
+	assert.NotNil(t, err)
+
+	plaintext, _, err := imported.Decrypt(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", plaintext)
+	assert.True(t, imported.Verified())
+}
+
+func TestPickleSessions(t *testing.T) {
+	outbound, err := NewOutboundSession()
+	assert.Nil(t, err)
+
+	inbound, err := NewInboundSession(outbound.GetSessionKey())
+	assert.Nil(t, err)
+
+	outbound.Encrypt("advance the ratchet")
+
+	pickledOutbound, err := json.Marshal(outbound)
+	assert.Nil(t, err)
+	pickledInbound, err := json.Marshal(inbound)
+	assert.Nil(t, err)
+
+	restoredOutbound := &OutboundSession{}
+	assert.Nil(t, json.Unmarshal(pickledOutbound, restoredOutbound))
+	restoredInbound := &InboundSession{}
+	assert.Nil(t, json.Unmarshal(pickledInbound, restoredInbound))
+
+	assert.Equal(t, outbound.GetSessionID(), restoredOutbound.GetSessionID())
+	assert.Equal(t, uint32(1), restoredOutbound.MessageIndex())
+	assert.Equal(t, outbound.CreationTime().Unix(), restoredOutbound.CreationTime().Unix())
+	assert.True(t, restoredInbound.Verified())
+
+	_, ciphertext := restoredOutbound.Encrypt("after restart")
+	plaintext, index, err := restoredInbound.Decrypt(ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), index)
+	assert.Equal(t, "after restart", plaintext)
+}
@@ -0,0 +1,74 @@
+package megolm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// A session used to encrypt messages that we send to a room. It implements the same
+// methods as libolm.GroupSession.
+type OutboundSession struct {
+	ratchet      ratchet
+	signingKey   ed25519.PrivateKey
+	creationTime time.Time
+}
+
+// Create a new outbound session with a random ratchet and signing key.
+func NewOutboundSession() (*OutboundSession, error) {
+	data := make([]byte, ratchetLength)
+	if _, err := rand.Read(data); err != nil {
+		return nil, fmt.Errorf("Could not generate ratchet: %s", err)
+	}
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate signing key: %s", err)
+	}
+
+	return &OutboundSession{
+		ratchet:      ratchetFromBytes(data, 0),
+		signingKey:   signingKey,
+		creationTime: time.Now(),
+	}, nil
+}
+
+// When the session was created, used to decide when it should be rotated.
+func (s *OutboundSession) CreationTime() time.Time {
+	return s.creationTime
+}
+
+// The session ID, which is the session's public signing key.
+func (s *OutboundSession) GetSessionID() string {
+	return encode(s.signingKey.Public().(ed25519.PublicKey))
+}
+
+// The index of the next message that will be encrypted.
+func (s *OutboundSession) MessageIndex() uint32 {
+	return s.ratchet.counter
+}
+
+// The signed session key to send to other devices in an m.room_key event so that they
+// can decrypt messages from the current index onwards.
+func (s *OutboundSession) GetSessionKey() string {
+	data := []byte{sessionKeyVersion}
+	data = append(data, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(data[1:], s.ratchet.counter)
+	data = append(data, s.ratchet.bytes()...)
+	data = append(data, s.signingKey.Public().(ed25519.PublicKey)...)
+	data = append(data, ed25519.Sign(s.signingKey, data)...)
+	return encode(data)
+}
+
+// Encrypt a message and advance the ratchet. The first return value is always 0 and
+// only exists to satisfy libolm.Encrypter.
+func (s *OutboundSession) Encrypt(plaintext string) (int, string) {
+	payload := encodeMessage(s.ratchet.counter, s.ratchet.encrypt([]byte(plaintext)))
+	payload = append(payload, s.ratchet.mac(payload)...)
+	payload = append(payload, ed25519.Sign(s.signingKey, payload)...)
+
+	s.ratchet.advance()
+	return 0, encode(payload)
+}
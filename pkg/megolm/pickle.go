@@ -0,0 +1,89 @@
+package megolm
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type pickledOutboundSession struct {
+	Ratchet    string `json:"ratchet"`
+	Counter    uint32 `json:"counter"`
+	SigningKey string `json:"signingKey"`
+	// Milliseconds since the unix epoch.
+	CreationTime int64 `json:"creationTime"`
+}
+
+type pickledInboundSession struct {
+	Ratchet    string `json:"ratchet"`
+	Counter    uint32 `json:"counter"`
+	SigningKey string `json:"signingKey"`
+	Verified   bool   `json:"verified"`
+}
+
+// Serialize the session, including its private signing key, so that it can be
+// persisted and restored with UnmarshalJSON.
+func (s *OutboundSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pickledOutboundSession{
+		Ratchet:      encode(s.ratchet.bytes()),
+		Counter:      s.ratchet.counter,
+		SigningKey:   encode(s.signingKey.Seed()),
+		CreationTime: s.creationTime.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (s *OutboundSession) UnmarshalJSON(data []byte) error {
+	pickled := pickledOutboundSession{}
+	if err := json.Unmarshal(data, &pickled); err != nil {
+		return err
+	}
+
+	ratchetData, err := decode(pickled.Ratchet)
+	if err != nil || len(ratchetData) != ratchetLength {
+		return fmt.Errorf("Invalid pickled ratchet")
+	}
+
+	seed, err := decode(pickled.SigningKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("Invalid pickled signing key")
+	}
+
+	s.ratchet = ratchetFromBytes(ratchetData, pickled.Counter)
+	s.signingKey = ed25519.NewKeyFromSeed(seed)
+	s.creationTime = time.Unix(0, pickled.CreationTime*int64(time.Millisecond))
+	return nil
+}
+
+// Serialize the session so that it can be persisted and restored with UnmarshalJSON.
+func (s *InboundSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pickledInboundSession{
+		Ratchet:    encode(s.initial.bytes()),
+		Counter:    s.initial.counter,
+		SigningKey: encode(s.signingKey),
+		Verified:   s.verified,
+	})
+}
+
+func (s *InboundSession) UnmarshalJSON(data []byte) error {
+	pickled := pickledInboundSession{}
+	if err := json.Unmarshal(data, &pickled); err != nil {
+		return err
+	}
+
+	ratchetData, err := decode(pickled.Ratchet)
+	if err != nil || len(ratchetData) != ratchetLength {
+		return fmt.Errorf("Invalid pickled ratchet")
+	}
+
+	signingKey, err := decode(pickled.SigningKey)
+	if err != nil || len(signingKey) != publicKeyLength {
+		return fmt.Errorf("Invalid pickled signing key")
+	}
+
+	s.initial = ratchetFromBytes(ratchetData, pickled.Counter)
+	s.latest = s.initial
+	s.signingKey = ed25519.PublicKey(signingKey)
+	s.verified = pickled.Verified
+	return nil
+}